@@ -0,0 +1,63 @@
+package ack
+
+import (
+	"fmt"
+
+	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/data/coerce"
+	"github.com/project-flogo/core/data/metadata"
+	"github.com/project-flogo/core/support/log"
+	pulsarconn "github.com/wcn00/pulsar/connector/connection"
+)
+
+var logger = log.ChildLogger(log.RootLogger(), "pulsar-ack")
+
+func init() {
+	_ = activity.Register(&Activity{}, New)
+}
+
+var activityMd = activity.ToMetadata(&Settings{}, &Input{})
+
+// New optional factory method, should be used if one activity instance per configuration is desired
+func New(ctx activity.InitContext) (act activity.Activity, err error) {
+	s := &Settings{}
+	err = metadata.MapToStruct(ctx.Settings(), s, true)
+	if err != nil {
+		return
+	}
+	connManager, err := coerce.ToConnection(s.Connection)
+	if err != nil {
+		return
+	}
+	pending, ok := connManager.(pulsarconn.ManualAckConnection)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support Manual ack mode")
+	}
+	act = &Activity{pending: pending}
+	return
+}
+
+// Activity acks or nacks a message a subscriber handler in Manual ack mode left to the flow
+type Activity struct {
+	pending pulsarconn.ManualAckConnection
+}
+
+// Metadata returns the activity's metadata
+func (a *Activity) Metadata() *activity.Metadata {
+	return activityMd
+}
+
+// Eval implements api.Activity.Eval - acks or nacks the message
+func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
+	input := &Input{}
+	err = ctx.GetInputObject(input)
+	if err != nil {
+		return true, err
+	}
+	logger.Debugf("ack message %s on subscription %s, nack: %v", input.MsgID, input.Subscription, input.Nack)
+	err = a.pending.AckMessage(input.MsgID, input.Subscription, !input.Nack)
+	if err != nil {
+		return true, err
+	}
+	return true, nil
+}
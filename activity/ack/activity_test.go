@@ -0,0 +1,76 @@
+package ack
+
+import (
+	"testing"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/data/mapper"
+	"github.com/project-flogo/core/data/resolve"
+	"github.com/project-flogo/core/support/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/wcn00/pulsar/connector/connection"
+)
+
+type fakeConsumer struct {
+	pulsar.Consumer
+	acked  int
+	nacked int
+}
+
+func (c *fakeConsumer) Ack(msg pulsar.Message) error {
+	c.acked++
+	return nil
+}
+
+func (c *fakeConsumer) Nack(msg pulsar.Message) {
+	c.nacked++
+}
+
+type fakeMessage struct {
+	pulsar.Message
+	id pulsar.MessageID
+}
+
+func (m *fakeMessage) ID() pulsar.MessageID {
+	return m.id
+}
+
+func TestRegister(t *testing.T) {
+	ref := activity.GetRef(&Activity{})
+	act := activity.Get(ref)
+
+	assert.NotNil(t, act)
+}
+
+func TestEval(t *testing.T) {
+	var factory connection.Factory
+	manager, err := factory.NewManager(map[string]interface{}{"name": "ack", "url": "pulsar://localhost:6650"})
+	assert.Nil(t, err)
+	consumer := &fakeConsumer{}
+	pending := manager.(connection.ManualAckConnection)
+	first := pending.AddPendingMessage("orders-sub", consumer, &fakeMessage{id: pulsar.NewMessageID(1, 1, -1, -1)}, nil)
+	second := pending.AddPendingMessage("orders-sub", consumer, &fakeMessage{id: pulsar.NewMessageID(1, 2, -1, -1)}, nil)
+
+	iCtx := test.NewActivityInitContext(map[string]interface{}{"connection": manager}, mapper.NewFactory(resolve.GetBasicResolver()))
+	act, err := New(iCtx)
+	assert.Nil(t, err)
+
+	tc := test.NewActivityContext(act.Metadata())
+	tc.SetInput("msgid", first)
+	_, err = act.Eval(tc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, consumer.acked)
+
+	// a message is only acked once
+	_, err = act.Eval(tc)
+	assert.NotNil(t, err)
+
+	tc = test.NewActivityContext(act.Metadata())
+	tc.SetInput("msgid", second)
+	tc.SetInput("subscription", "orders-sub")
+	tc.SetInput("nack", true)
+	_, err = act.Eval(tc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, consumer.nacked)
+}
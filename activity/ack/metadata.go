@@ -0,0 +1,44 @@
+package ack
+
+import (
+	"github.com/project-flogo/core/data/coerce"
+	"github.com/project-flogo/core/support/connection"
+)
+
+// Settings Activity Settings
+type Settings struct {
+	Connection connection.Manager `md:"connection,required"`
+}
+
+// Input to the ack activity
+type Input struct {
+	MsgID        string `md:"msgid,required"`
+	Subscription string `md:"subscription"`
+	Nack         bool   `md:"nack"`
+}
+
+// FromMap frommap
+func (r *Input) FromMap(values map[string]interface{}) (err error) {
+	r.MsgID, err = coerce.ToString(values["msgid"])
+	if err != nil {
+		return
+	}
+	r.Subscription, err = coerce.ToString(values["subscription"])
+	if err != nil {
+		return
+	}
+	r.Nack, err = coerce.ToBool(values["nack"])
+	if err != nil {
+		return
+	}
+	return
+}
+
+// ToMap tomap
+func (r *Input) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"msgid":        r.MsgID,
+		"subscription": r.Subscription,
+		"nack":         r.Nack,
+	}
+}
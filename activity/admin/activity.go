@@ -0,0 +1,185 @@
+package admin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/data/coerce"
+	"github.com/project-flogo/core/data/metadata"
+	"github.com/project-flogo/core/support/log"
+	pulsarconn "github.com/wcn00/pulsar/connector/connection"
+)
+
+var logger = log.ChildLogger(log.RootLogger(), "pulsar-admin")
+
+func init() {
+	_ = activity.Register(&Activity{}, New)
+}
+
+var activityMd = activity.ToMetadata(&Settings{}, &Input{}, &Output{})
+
+// operations supported by the activity and the inputs they require
+var operations = map[string][]string{
+	"createTopic":        {"topic"},
+	"deleteTopic":        {"topic"},
+	"listTopics":         {"namespace"},
+	"createSubscription": {"topic", "subscription"},
+	"deleteSubscription": {"topic", "subscription"},
+	"resetSubscription":  {"topic", "subscription"},
+	"skipMessages":       {"topic", "subscription"},
+	"clearBacklog":       {"topic", "subscription"},
+	"topicStats":         {"topic"},
+	"internalStats":      {"topic"},
+}
+
+// New optional factory method, should be used if one activity instance per configuration is desired
+func New(ctx activity.InitContext) (act activity.Activity, err error) {
+	s := &Settings{}
+	err = metadata.MapToStruct(ctx.Settings(), s, true)
+	if err != nil {
+		return
+	}
+	if _, ok := operations[s.Operation]; !ok {
+		return nil, fmt.Errorf("unsupported pulsar admin operation %s", s.Operation)
+	}
+	connManager, err := coerce.ToConnection(s.Connection)
+	if err != nil {
+		return
+	}
+	adminConn, ok := connManager.(pulsarconn.AdminConnection)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support the pulsar admin api")
+	}
+	admin, err := adminConn.AdminClient()
+	if err != nil {
+		return
+	}
+	act = &Activity{operation: s.Operation, admin: admin}
+	return
+}
+
+// Activity performs a pulsar admin operation through the admin api of the connection
+type Activity struct {
+	operation string
+	admin     *pulsarconn.AdminClient
+}
+
+// Metadata returns the activity's metadata
+func (a *Activity) Metadata() *activity.Metadata {
+	return activityMd
+}
+
+// Eval implements api.Activity.Eval - performs the admin operation
+func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
+	input := &Input{}
+	err = ctx.GetInputObject(input)
+	if err != nil {
+		return true, err
+	}
+	err = checkInput(a.operation, input)
+	if err != nil {
+		return true, err
+	}
+	logger.Debugf("pulsar admin %s topic: %s subscription: %s", a.operation, input.Topic, input.Subscription)
+	result, err := a.perform(input)
+	if err != nil {
+		return true, fmt.Errorf("pulsar admin %s failed: %v", a.operation, err)
+	}
+	err = ctx.SetOutputObject(&Output{Result: result})
+	if err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func (a *Activity) perform(input *Input) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	if input.Topic != "" {
+		result["topic"] = input.Topic
+	}
+	if input.Subscription != "" {
+		result["subscription"] = input.Subscription
+	}
+	switch a.operation {
+	case "createTopic":
+		result["partitions"] = input.Partitions
+		return result, a.admin.CreateTopic(input.Topic, input.Partitions)
+	case "deleteTopic":
+		partitions, err := a.admin.GetPartitions(input.Topic)
+		if err != nil {
+			return nil, err
+		}
+		return result, a.admin.DeleteTopic(input.Topic, partitions > 0, input.Force)
+	case "listTopics":
+		partitioned, nonPartitioned, err := a.admin.ListTopics(input.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		result["namespace"] = input.Namespace
+		result["partitioned"] = toInterfaces(partitioned)
+		result["nonPartitioned"] = toInterfaces(nonPartitioned)
+		return result, nil
+	case "createSubscription":
+		position := input.Position
+		if position == "" {
+			position = "Latest"
+		}
+		result["position"] = position
+		return result, a.admin.CreateSubscription(input.Topic, input.Subscription, position)
+	case "deleteSubscription":
+		return result, a.admin.DeleteSubscription(input.Topic, input.Subscription, input.Force)
+	case "resetSubscription":
+		result["timestamp"] = input.Timestamp
+		timestamp := time.Unix(0, input.Timestamp*int64(time.Millisecond))
+		return result, a.admin.ResetSubscription(input.Topic, input.Subscription, timestamp)
+	case "skipMessages":
+		result["count"] = input.Count
+		return result, a.admin.SkipMessages(input.Topic, input.Subscription, input.Count)
+	case "clearBacklog":
+		return result, a.admin.ClearBacklog(input.Topic, input.Subscription)
+	default:
+		partitions, err := a.admin.GetPartitions(input.Topic)
+		if err != nil {
+			return nil, err
+		}
+		var stats map[string]interface{}
+		if a.operation == "topicStats" {
+			stats, err = a.admin.TopicStats(input.Topic, partitions > 0)
+		} else {
+			stats, err = a.admin.TopicInternalStats(input.Topic, partitions > 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result["partitions"] = partitions
+		result["stats"] = stats
+		return result, nil
+	}
+}
+
+func checkInput(operation string, input *Input) error {
+	for _, name := range operations[operation] {
+		if input.ToMap()[name] == "" {
+			return fmt.Errorf("pulsar admin %s requires the %s input", operation, name)
+		}
+	}
+	if input.Position != "" && input.Position != "Earliest" && input.Position != "Latest" {
+		return fmt.Errorf("position must be Earliest or Latest")
+	}
+	if input.Partitions < 0 || input.Count < 0 {
+		return fmt.Errorf("partitions and count can not be negative")
+	}
+	if operation == "skipMessages" && input.Count == 0 {
+		return fmt.Errorf("pulsar admin skipMessages requires a count")
+	}
+	return nil
+}
+
+func toInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/data/mapper"
+	"github.com/project-flogo/core/data/resolve"
+	"github.com/project-flogo/core/support/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/wcn00/pulsar/connector/connection"
+)
+
+func newAdminServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /admin/v2/persistent/public/default/orders/partitions":
+			_, _ = w.Write([]byte(`{"partitions":2}`))
+		case "GET /admin/v2/persistent/public/default/orders/partitioned-stats":
+			_, _ = w.Write([]byte(`{"msgInCounter":42}`))
+		case "GET /admin/v2/persistent/public/default/partitioned":
+			_, _ = w.Write([]byte(`["persistent://public/default/orders"]`))
+		case "GET /admin/v2/persistent/public/default":
+			_, _ = w.Write([]byte(`[]`))
+		case "PUT /admin/v2/persistent/public/default/orders/subscription/audit":
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"reason":"Subscription already exists for topic"}`))
+		default:
+			t.Errorf("unexpected admin request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func newActivity(t *testing.T, adminURL string, operation string) activity.Activity {
+	var factory connection.Factory
+	manager, err := factory.NewManager(map[string]interface{}{
+		"name":     "admin",
+		"url":      "pulsar://localhost:6650",
+		"adminUrl": adminURL,
+	})
+	assert.Nil(t, err)
+	settings := map[string]interface{}{"connection": manager, "operation": operation}
+	iCtx := test.NewActivityInitContext(settings, mapper.NewFactory(resolve.GetBasicResolver()))
+	act, err := New(iCtx)
+	assert.Nil(t, err)
+	return act
+}
+
+func TestRegister(t *testing.T) {
+	ref := activity.GetRef(&Activity{})
+	act := activity.Get(ref)
+
+	assert.NotNil(t, act)
+}
+
+func TestTopicStats(t *testing.T) {
+	server := newAdminServer(t)
+	defer server.Close()
+	act := newActivity(t, server.URL, "topicStats")
+	tc := test.NewActivityContext(act.Metadata())
+	tc.SetInput("topic", "persistent://public/default/orders")
+	_, err := act.Eval(tc)
+	assert.Nil(t, err)
+	result := tc.GetOutput("result").(map[string]interface{})
+	assert.Equal(t, 2, result["partitions"])
+	assert.Equal(t, float64(42), result["stats"].(map[string]interface{})["msgInCounter"])
+}
+
+func TestListTopics(t *testing.T) {
+	server := newAdminServer(t)
+	defer server.Close()
+	act := newActivity(t, server.URL, "listTopics")
+	tc := test.NewActivityContext(act.Metadata())
+	tc.SetInput("namespace", "public/default")
+	_, err := act.Eval(tc)
+	assert.Nil(t, err)
+	result := tc.GetOutput("result").(map[string]interface{})
+	assert.Equal(t, []interface{}{"persistent://public/default/orders"}, result["partitioned"])
+	assert.Equal(t, []interface{}{}, result["nonPartitioned"])
+}
+
+func TestCreateSubscriptionFails(t *testing.T) {
+	server := newAdminServer(t)
+	defer server.Close()
+	act := newActivity(t, server.URL, "createSubscription")
+	tc := test.NewActivityContext(act.Metadata())
+	tc.SetInput("topic", "orders")
+	_, err := act.Eval(tc)
+	assert.EqualError(t, err, "pulsar admin createSubscription requires the subscription input")
+
+	tc.SetInput("subscription", "audit")
+	_, err = act.Eval(tc)
+	assert.Contains(t, err.Error(), "Subscription already exists for topic")
+}
+
+func TestUnsupportedOperation(t *testing.T) {
+	var factory connection.Factory
+	manager, err := factory.NewManager(map[string]interface{}{"name": "admin", "url": "pulsar://localhost:6650"})
+	assert.Nil(t, err)
+	settings := map[string]interface{}{"connection": manager, "operation": "dropEverything"}
+	_, err = New(test.NewActivityInitContext(settings, mapper.NewFactory(resolve.GetBasicResolver())))
+	assert.NotNil(t, err)
+
+	// the connection has no adminUrl
+	settings["operation"] = "topicStats"
+	_, err = New(test.NewActivityInitContext(settings, mapper.NewFactory(resolve.GetBasicResolver())))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"github.com/project-flogo/core/data/coerce"
+	"github.com/project-flogo/core/support/connection"
+)
+
+// Settings Activity Settings
+type Settings struct {
+	Connection connection.Manager `md:"connection,required"`
+	Operation  string             `md:"operation,required"`
+}
+
+// Input to the admin activity, which fields are used depends on the operation
+type Input struct {
+	Namespace    string `md:"namespace"`
+	Topic        string `md:"topic"`
+	Partitions   int    `md:"partitions"`
+	Subscription string `md:"subscription"`
+	Position     string `md:"position"`
+	Timestamp    int64  `md:"timestamp"`
+	Count        int    `md:"count"`
+	Force        bool   `md:"force"`
+}
+
+// FromMap frommap
+func (r *Input) FromMap(values map[string]interface{}) (err error) {
+	r.Namespace, err = coerce.ToString(values["namespace"])
+	if err != nil {
+		return
+	}
+	r.Topic, err = coerce.ToString(values["topic"])
+	if err != nil {
+		return
+	}
+	r.Partitions, err = coerce.ToInt(values["partitions"])
+	if err != nil {
+		return
+	}
+	r.Subscription, err = coerce.ToString(values["subscription"])
+	if err != nil {
+		return
+	}
+	r.Position, err = coerce.ToString(values["position"])
+	if err != nil {
+		return
+	}
+	r.Timestamp, err = coerce.ToInt64(values["timestamp"])
+	if err != nil {
+		return
+	}
+	r.Count, err = coerce.ToInt(values["count"])
+	if err != nil {
+		return
+	}
+	r.Force, err = coerce.ToBool(values["force"])
+	if err != nil {
+		return
+	}
+	return
+}
+
+// ToMap tomap
+func (r *Input) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"namespace":    r.Namespace,
+		"topic":        r.Topic,
+		"partitions":   r.Partitions,
+		"subscription": r.Subscription,
+		"position":     r.Position,
+		"timestamp":    r.Timestamp,
+		"count":        r.Count,
+		"force":        r.Force,
+	}
+}
+
+// Output of the admin activity
+type Output struct {
+	Result map[string]interface{} `md:"result"`
+}
+
+// FromMap frommap
+func (o *Output) FromMap(values map[string]interface{}) (err error) {
+	o.Result, err = coerce.ToObject(values["result"])
+	if err != nil {
+		return
+	}
+	return
+}
+
+// ToMap tomap
+func (o *Output) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"result": o.Result,
+	}
+}
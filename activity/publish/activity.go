@@ -3,13 +3,16 @@ package publish
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/project-flogo/core/activity"
 	"github.com/project-flogo/core/data"
 	"github.com/project-flogo/core/data/coerce"
 	"github.com/project-flogo/core/data/metadata"
+	"github.com/project-flogo/core/support/connection"
 	"github.com/project-flogo/core/support/log"
+	pulsarconn "github.com/wcn00/pulsar/connector/connection"
 )
 
 var logger = log.ChildLogger(log.RootLogger(), "pulsar-publish")
@@ -31,7 +34,10 @@ func New(ctx activity.InitContext) (act activity.Activity, err error) {
 	if err != nil {
 		return
 	}
-	pulsarClient := connManager.GetConnection().(pulsar.Client)
+	pulsarClient, ok := connManager.GetConnection().(pulsar.Client)
+	if !ok {
+		return nil, fmt.Errorf("pulsar connection is not available")
+	}
 
 	producerOptions := pulsar.ProducerOptions{
 		Topic: ctx.Settings()["topic"].(string),
@@ -47,17 +53,103 @@ func New(ctx activity.InitContext) (act activity.Activity, err error) {
 		producerOptions.CompressionType = pulsar.NoCompression
 	}
 
+	encoder, err := newPayloadEncoder(s)
+	if err != nil {
+		connManager.ReleaseConnection(pulsarClient)
+		return nil, err
+	}
+	if encoder != nil && encoder.schema != nil {
+		producerOptions.Schema = encoder.schema
+	}
+
 	producer, err := pulsarClient.CreateProducer(producerOptions)
 	if err != nil {
+		connManager.ReleaseConnection(pulsarClient)
 		return nil, fmt.Errorf("Could not instantiate Pulsar producer: %v", err)
 	}
-	act = &Activity{producer: producer}
+	activity := &Activity{connection: connManager, client: pulsarClient, producerOptions: producerOptions, producer: producer, encoder: encoder}
+	if failover, ok := connManager.(pulsarconn.FailoverConnection); ok {
+		activity.removeListener = failover.AddClientListener(activity.switchClient)
+	}
+	act = activity
 	return
 }
 
 // Activity is an sample Activity that can be used as a base to create a custom activity
 type Activity struct {
-	producer pulsar.Producer
+	mutex           sync.RWMutex
+	connection      connection.Manager
+	client          pulsar.Client
+	producerOptions pulsar.ProducerOptions
+	producer        pulsar.Producer
+	encoder         *payloadEncoder
+	removeListener  func()
+}
+
+// switchClient re-creates the producer on the client of the cluster the connection failed over to
+func (a *Activity) switchClient(client pulsar.Client) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.client == nil {
+		return
+	}
+	a.client = client
+	previous := a.producer
+	producer, err := client.CreateProducer(a.producerOptions)
+	if err != nil {
+		logger.Errorf("could not re-create producer for %s after failover, retrying on the next publish: %v", a.producerOptions.Topic, err)
+		a.producer = nil
+	} else {
+		a.producer = producer
+	}
+	if previous != nil {
+		previous.Close()
+	}
+}
+
+// getProducer returns the producer, it is re-created when the failover could not create it
+func (a *Activity) getProducer() (pulsar.Producer, error) {
+	a.mutex.RLock()
+	producer := a.producer
+	a.mutex.RUnlock()
+	if producer != nil {
+		return producer, nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.producer != nil {
+		return a.producer, nil
+	}
+	if a.client == nil {
+		return nil, fmt.Errorf("Producer for %s is not available", a.producerOptions.Topic)
+	}
+	producer, err := a.client.CreateProducer(a.producerOptions)
+	if err != nil {
+		return nil, fmt.Errorf("Producer for %s is not available: %v", a.producerOptions.Topic, err)
+	}
+	logger.Infof("re-created producer for %s", a.producerOptions.Topic)
+	a.producer = producer
+	return producer, nil
+}
+
+// Cleanup implements support.NeedsCleanup, it flushes and closes the producer and releases the connection
+func (a *Activity) Cleanup() error {
+	logger.Debugf("publish cleanup called")
+	if a.removeListener != nil {
+		a.removeListener()
+		a.removeListener = nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.producer != nil {
+		a.producer.Close()
+		a.producer = nil
+	}
+	if a.client != nil {
+		a.connection.ReleaseConnection(a.client)
+		a.client = nil
+	}
+	return nil
 }
 
 // Metadata returns the activity's metadata
@@ -73,20 +165,17 @@ func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
 	if err != nil {
 		return true, err
 	}
-	var msgBytes interface{}
-	if input.PayloadStr != nil {
-		msgBytes, err = coerce.ToType(input.PayloadStr, data.TypeBytes)
-		if err != nil {
-			return true, err
-		}
-	} else if input.PayloadJSON != nil {
-		msgBytes, err = coerce.ToType(input.PayloadJSON, data.TypeBytes)
-		if err != nil {
-			return true, err
-		}
+	var payload []byte
+	if a.encoder != nil {
+		payload, err = a.encoder.encode(input)
+	} else {
+		payload, err = payloadBytes(input)
+	}
+	if err != nil {
+		return true, err
 	}
 	msg := pulsar.ProducerMessage{
-		Payload: msgBytes.([]byte),
+		Payload: payload,
 	}
 	if input.Properties != nil {
 		props, err := coerce.ToType(input.Properties, data.TypeParams)
@@ -105,7 +194,11 @@ func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
 		msg.Key = keyStr.(string)
 	}
 
-	msgID, err := a.producer.Send(context.Background(), &msg)
+	producer, err := a.getProducer()
+	if err != nil {
+		return true, err
+	}
+	msgID, err := producer.Send(context.Background(), &msg)
 	if err != nil {
 		return true, fmt.Errorf("Producer could not send message: %v", err)
 	}
@@ -2,9 +2,13 @@ package publish
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"testing"
 
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/linkedin/goavro/v2"
 	"github.com/project-flogo/core/activity"
 	"github.com/project-flogo/core/data/mapper"
 	"github.com/project-flogo/core/data/resolve"
@@ -60,3 +64,166 @@ func TestEval(t *testing.T) {
 	msgid := tc.GetOutput("msgid")
 	fmt.Printf("msgid is: %s \n", msgid)
 }
+
+const orderSchema = `{"type":"record","name":"Order","fields":[{"name":"id","type":"string"},{"name":"amount","type":"double"},{"name":"note","type":["null","string"],"default":null}]}`
+
+func TestPayloadEncoder(t *testing.T) {
+	encoder, err := newPayloadEncoder(&Settings{SchemaType: "AVRO", Schema: orderSchema})
+	assert.Nil(t, err)
+	payload, err := encoder.encode(&Input{PayloadJSON: map[string]interface{}{"id": "o-1", "amount": 9.5}})
+	assert.Nil(t, err)
+	var order map[string]interface{}
+	assert.Nil(t, encoder.schema.Decode(payload, &order))
+	assert.Equal(t, "o-1", order["id"])
+	_, err = encoder.encode(&Input{PayloadJSON: map[string]interface{}{"id": "o-1"}})
+	assert.NotNil(t, err)
+	_, err = encoder.encode(&Input{PayloadJSON: map[string]interface{}{"id": "o-1", "amount": "lots"}})
+	assert.NotNil(t, err)
+	// optional fields take plain values
+	payload, err = encoder.encode(&Input{PayloadJSON: map[string]interface{}{"id": "o-1", "amount": 9.5, "note": "hello"}})
+	assert.Nil(t, err)
+	order = nil
+	assert.Nil(t, encoder.schema.Decode(payload, &order))
+	assert.Equal(t, map[string]interface{}{"string": "hello"}, order["note"])
+
+	encoder, err = newPayloadEncoder(&Settings{SchemaType: "JSON", Schema: orderSchema})
+	assert.Nil(t, err)
+	payload, err = encoder.encode(&Input{PayloadStr: `{"id":"o-2","amount":1}`})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id":"o-2","amount":1}`, string(payload))
+	payload, err = encoder.encode(&Input{PayloadStr: `{"id":"o-2","amount":1,"note":"hello"}`})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id":"o-2","amount":1,"note":"hello"}`, string(payload))
+	_, err = encoder.encode(&Input{PayloadStr: `{"id":"o-2","amount":"lots"}`})
+	assert.NotNil(t, err)
+	_, err = encoder.encode(&Input{PayloadStr: `{"id":"o-2","amount":1,"note":7}`})
+	assert.NotNil(t, err)
+	_, err = encoder.encode(&Input{PayloadStr: "not json"})
+	assert.NotNil(t, err)
+
+	encoder, err = newPayloadEncoder(&Settings{SchemaType: "STRING"})
+	assert.Nil(t, err)
+	payload, err = encoder.encode(&Input{PayloadStr: "mary had a little lamb"})
+	assert.Nil(t, err)
+	assert.Equal(t, "mary had a little lamb", string(payload))
+
+	encoder, err = newPayloadEncoder(&Settings{})
+	assert.Nil(t, err)
+	assert.Nil(t, encoder)
+	_, err = newPayloadEncoder(&Settings{SchemaType: "AVRO"})
+	assert.NotNil(t, err)
+	_, err = newPayloadEncoder(&Settings{SchemaType: "XML"})
+	assert.NotNil(t, err)
+}
+
+// orderDescriptorSet is the file setting of a descriptor set with the message demo.Order, a copy of
+// the connection module's testdata/order.desc.json
+func orderDescriptorSet(t *testing.T) string {
+	setting, err := ioutil.ReadFile("testdata/order.desc.json")
+	assert.Nil(t, err)
+	return string(setting)
+}
+
+func TestAvroUnions(t *testing.T) {
+	schema := `{"type":"record","name":"Order","namespace":"demo","fields":[
+		{"name":"customer","type":["null",{"type":"record","name":"Customer","fields":[{"name":"email","type":["null","string"]}]}]},
+		{"name":"previous","type":["null","Customer"],"default":null},
+		{"name":"tags","type":{"type":"array","items":["long","string"]}},
+		{"name":"totals","type":{"type":"map","values":["null","double"]}}]}`
+	encoder, err := newPayloadEncoder(&Settings{SchemaType: "AVRO", Schema: schema})
+	assert.Nil(t, err)
+	payload, err := encoder.encode(&Input{PayloadJSON: map[string]interface{}{
+		"customer": map[string]interface{}{"email": "mary@example.com"},
+		"previous": map[string]interface{}{"email": nil},
+		"tags":     []interface{}{"rush", float64(7)},
+		"totals":   map[string]interface{}{"net": 1.5, "tax": nil},
+	}})
+	assert.Nil(t, err)
+	codec, err := goavro.NewCodec(schema)
+	assert.Nil(t, err)
+	native, _, err := codec.NativeFromBinary(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"customer": map[string]interface{}{"demo.Customer": map[string]interface{}{"email": map[string]interface{}{"string": "mary@example.com"}}},
+		"previous": map[string]interface{}{"demo.Customer": map[string]interface{}{"email": nil}},
+		"tags":     []interface{}{map[string]interface{}{"string": "rush"}, map[string]interface{}{"long": int64(7)}},
+		"totals":   map[string]interface{}{"net": map[string]interface{}{"double": 1.5}, "tax": nil},
+	}, native)
+
+	_, err = encoder.encode(&Input{PayloadJSON: map[string]interface{}{"customer": nil, "previous": nil, "tags": []interface{}{true}, "totals": map[string]interface{}{}}})
+	assert.NotNil(t, err)
+	// a nullable field without a default is still required
+	_, err = encoder.encode(&Input{PayloadJSON: map[string]interface{}{"tags": []interface{}{}, "totals": map[string]interface{}{}}})
+	assert.NotNil(t, err)
+}
+
+func TestProtobufEncoder(t *testing.T) {
+	encoder, err := newPayloadEncoder(&Settings{SchemaType: "PROTOBUF", ProtoDescriptor: orderDescriptorSet(t), ProtoMessage: "demo.Order"})
+	assert.Nil(t, err)
+	assert.Nil(t, encoder.schema)
+	payload, err := encoder.encode(&Input{PayloadJSON: map[string]interface{}{"order_id": "o-1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0a, 0x03, 'o', '-', '1'}, payload)
+	_, err = encoder.encode(&Input{PayloadJSON: map[string]interface{}{"order_id": "o-1", "colour": "red"}})
+	assert.Contains(t, err.Error(), `invalid messageObj: object does not match demo.Order`)
+
+	_, err = newPayloadEncoder(&Settings{SchemaType: "PROTOBUF", ProtoDescriptor: orderDescriptorSet(t), ProtoMessage: "demo.Missing"})
+	assert.NotNil(t, err)
+}
+
+func TestPayloadBytes(t *testing.T) {
+	blob := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe}
+	payload, err := payloadBytes(&Input{Payload: blob, PayloadStr: "ignored"})
+	assert.Nil(t, err)
+	assert.Equal(t, blob, payload)
+	payload, err = payloadBytes(&Input{PayloadBase64: "iVBORwD//g==", PayloadStr: ""})
+	assert.Nil(t, err)
+	assert.Equal(t, blob, payload)
+	_, err = payloadBytes(&Input{PayloadBase64: "not base64!"})
+	assert.NotNil(t, err)
+	payload, err = payloadBytes(&Input{PayloadStr: "", PayloadJSON: map[string]interface{}{"id": "o-1"}})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id":"o-1"}`, string(payload))
+
+	encoder, err := newPayloadEncoder(&Settings{SchemaType: "BYTES"})
+	assert.Nil(t, err)
+	payload, err = encoder.encode(&Input{Payload: blob})
+	assert.Nil(t, err)
+	assert.Equal(t, blob, payload)
+}
+
+type fakeProducer struct {
+	pulsar.Producer
+}
+
+func (p *fakeProducer) Close() {}
+
+type fakeClient struct {
+	pulsar.Client
+	failures int
+	created  int
+}
+
+func (c *fakeClient) CreateProducer(options pulsar.ProducerOptions) (pulsar.Producer, error) {
+	if c.failures > 0 {
+		c.failures--
+		return nil, errors.New("broker unavailable")
+	}
+	c.created++
+	return &fakeProducer{}, nil
+}
+
+func TestProducerRecreatedAfterFailover(t *testing.T) {
+	client := &fakeClient{failures: 2}
+	act := &Activity{client: &fakeClient{}, producer: &fakeProducer{}, producerOptions: pulsar.ProducerOptions{Topic: "orders"}}
+	act.switchClient(client)
+	assert.Nil(t, act.producer)
+
+	// the producer the failover could not create is created by the next publish
+	_, err := act.getProducer()
+	assert.NotNil(t, err)
+	producer, err := act.getProducer()
+	assert.Nil(t, err)
+	assert.NotNil(t, producer)
+	assert.Equal(t, 1, client.created)
+}
@@ -10,14 +10,20 @@ type Settings struct {
 	Connection      connection.Manager `md:"connection"`
 	Topic           string             `md:"topic,required"`
 	CompressionType string             `md:"compressiontype"`
+	SchemaType      string             `md:"schemaType"`
+	Schema          string             `md:"schema"`
+	ProtoDescriptor string             `md:"protoDescriptor"`
+	ProtoMessage    string             `md:"protoMessage"`
 }
 
 // Input to the publish activity
 type Input struct {
-	Key         interface{}       `md:"key"`
-	Properties  map[string]string `md:"properties"`
-	PayloadStr  interface{}       `md:"message"`
-	PayloadJSON interface{}       `md:"messageObj"`
+	Key           interface{}       `md:"key"`
+	Properties    map[string]string `md:"properties"`
+	PayloadStr    interface{}       `md:"message"`
+	PayloadJSON   interface{}       `md:"messageObj"`
+	Payload       []byte            `md:"payload"`
+	PayloadBase64 string            `md:"payloadBase64"`
 }
 
 // FromMap frommap
@@ -38,16 +44,26 @@ func (r *Input) FromMap(values map[string]interface{}) (err error) {
 	if err != nil {
 		return
 	}
+	r.Payload, err = coerce.ToBytes(values["payload"])
+	if err != nil {
+		return
+	}
+	r.PayloadBase64, err = coerce.ToString(values["payloadBase64"])
+	if err != nil {
+		return
+	}
 	return
 }
 
 // ToMap tomap
 func (r *Input) ToMap() map[string]interface{} {
 	return map[string]interface{}{
-		"key":        r.Key,
-		"properties": r.Properties,
-		"message":    r.PayloadStr,
-		"messageObj": r.PayloadJSON,
+		"key":           r.Key,
+		"properties":    r.Properties,
+		"message":       r.PayloadStr,
+		"messageObj":    r.PayloadJSON,
+		"payload":       r.Payload,
+		"payloadBase64": r.PayloadBase64,
 	}
 }
 
@@ -0,0 +1,166 @@
+package publish
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/linkedin/goavro/v2"
+	"github.com/project-flogo/core/data"
+	"github.com/project-flogo/core/data/coerce"
+	pulsarconn "github.com/wcn00/pulsar/connector/connection"
+)
+
+// payloadEncoder validates and encodes the message for the schema the producer registers
+type payloadEncoder struct {
+	schemaType string
+	schema     pulsar.Schema
+	codec      *goavro.Codec
+	proto      *pulsarconn.ProtoCodec
+}
+
+// newPayloadEncoder creates the encoder for a schemaType, JSON and AVRO need the schema definition.
+// Like the other pulsar clients JSON schemas are defined as an Avro record, messages of both are
+// checked against it.  PROTOBUF needs a descriptor set and a message name, the go client can not
+// register protobuf schemas.
+func newPayloadEncoder(s *Settings) (*payloadEncoder, error) {
+	schemaType, definition := s.SchemaType, s.Schema
+	e := &payloadEncoder{schemaType: schemaType}
+	var err error
+	switch schemaType {
+	case "":
+		return nil, nil
+	case "STRING":
+		e.schema = pulsar.NewStringSchema(nil)
+	case "BYTES":
+		e.schema = pulsar.NewBytesSchema(nil)
+	case "JSON", "AVRO":
+		if definition == "" {
+			return nil, fmt.Errorf("schemaType %s needs a schema definition", schemaType)
+		}
+		if schemaType == "JSON" {
+			e.schema, err = pulsar.NewJSONSchemaWithValidation(definition, nil)
+		} else {
+			e.schema, err = pulsar.NewAvroSchemaWithValidation(definition, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s schema: %v", schemaType, err)
+		}
+		e.codec, err = goavro.NewCodecForStandardJSON(definition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema definition: %v", err)
+		}
+	case "PROTOBUF":
+		e.proto, err = pulsarconn.NewProtoCodec(s.ProtoDescriptor, s.ProtoMessage)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("schemaType must be JSON, AVRO, STRING, BYTES or PROTOBUF")
+	}
+	return e, nil
+}
+
+// encode returns the payload of a message.  STRING sends the message input and BYTES the payload
+// like publishing without a schema.  JSON, AVRO and PROTOBUF validate and encode the messageObj
+// input, or the message input parsed as JSON when it is not mapped.
+func (e *payloadEncoder) encode(input *Input) ([]byte, error) {
+	switch e.schemaType {
+	case "STRING":
+		value := input.PayloadStr
+		if isEmpty(value) && input.PayloadJSON != nil {
+			value = input.PayloadJSON
+		}
+		str, err := coerce.ToString(value)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(str), nil
+	case "BYTES":
+		return payloadBytes(input)
+	}
+	obj, err := e.payloadObject(input)
+	if err != nil {
+		return nil, err
+	}
+	if e.proto != nil {
+		payload, err := e.proto.Encode(obj)
+		if err != nil {
+			return nil, fmt.Errorf("invalid messageObj: %v", err)
+		}
+		return payload, nil
+	}
+	record, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("messageObj must be an object for schemaType %s", e.schemaType)
+	}
+	payload, err := e.avroBinary(record)
+	if err != nil {
+		return nil, fmt.Errorf("messageObj does not match the %s schema: %v", e.schemaType, err)
+	}
+	if e.schemaType == "JSON" {
+		return e.schema.Encode(record)
+	}
+	return payload, nil
+}
+
+// avroBinary checks a record against the schema and returns its Avro binary encoding, union
+// fields take plain values like in the JSON the other pulsar clients send
+func (e *payloadEncoder) avroBinary(record map[string]interface{}) ([]byte, error) {
+	textual, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := e.codec.NativeFromTextual(textual)
+	if err != nil {
+		return nil, err
+	}
+	return e.codec.BinaryFromNative(nil, native)
+}
+
+func (e *payloadEncoder) payloadObject(input *Input) (interface{}, error) {
+	if input.PayloadJSON != nil {
+		return input.PayloadJSON, nil
+	}
+	str, err := coerce.ToString(input.PayloadStr)
+	if err != nil {
+		return nil, err
+	}
+	var obj interface{}
+	err = json.Unmarshal([]byte(str), &obj)
+	if err != nil {
+		return nil, fmt.Errorf("message is not a JSON object for schemaType %s: %v", e.schemaType, err)
+	}
+	return obj, nil
+}
+
+// payloadBytes returns the payload input, or the payloadBase64 input decoded, unchanged.  Without
+// them it coerces the message input, or the messageObj input when there is no message, to bytes.
+func payloadBytes(input *Input) ([]byte, error) {
+	if input.Payload != nil {
+		return input.Payload, nil
+	}
+	if input.PayloadBase64 != "" {
+		payload, err := base64.StdEncoding.DecodeString(input.PayloadBase64)
+		if err != nil {
+			return nil, fmt.Errorf("payloadBase64 is not base64 encoded: %v", err)
+		}
+		return payload, nil
+	}
+	var msgBytes interface{}
+	var err error
+	if !isEmpty(input.PayloadStr) {
+		msgBytes, err = coerce.ToType(input.PayloadStr, data.TypeBytes)
+	} else if input.PayloadJSON != nil {
+		msgBytes, err = coerce.ToType(input.PayloadJSON, data.TypeBytes)
+	}
+	if err != nil || msgBytes == nil {
+		return nil, err
+	}
+	return msgBytes.([]byte), nil
+}
+
+func isEmpty(value interface{}) bool {
+	return value == nil || value == ""
+}
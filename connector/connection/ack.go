@@ -0,0 +1,113 @@
+package connection
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// ManualAckConnection is implemented by connection managers that hold the messages a subscriber
+// handler in manual ack mode leaves to be acked by the flow
+type ManualAckConnection interface {
+	AddPendingMessage(subscription string, consumer pulsar.Consumer, msg pulsar.Message, settle func(ack bool) error) (msgID string)
+	RemovePendingMessages(consumer pulsar.Consumer)
+	RemovePendingMessage(msgID string, subscription string) bool
+	AckMessage(msgID string, subscription string, ack bool) error
+}
+
+type pendingMessage struct {
+	consumer pulsar.Consumer
+	msg      pulsar.Message
+	settle   func(ack bool) error
+}
+
+// PendingMessages holds received messages by message id and subscription until they are acked or
+// nacked.  It implements ManualAckConnection.
+type PendingMessages struct {
+	pendingMutex sync.Mutex
+	pending      map[string]map[string]pendingMessage
+}
+
+// AddPendingMessage holds a message, the returned id is the msgid output of the subscriber trigger.
+// When settle is not nil AckMessage leaves acking or nacking the message to it, so the handler can
+// retry or dead letter a nacked message.
+func (p *PendingMessages) AddPendingMessage(subscription string, consumer pulsar.Consumer, msg pulsar.Message, settle func(ack bool) error) (msgID string) {
+	msgID = fmt.Sprintf("%x", msg.ID().Serialize())
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	if p.pending == nil {
+		p.pending = make(map[string]map[string]pendingMessage)
+	}
+	if p.pending[msgID] == nil {
+		p.pending[msgID] = make(map[string]pendingMessage)
+	}
+	p.pending[msgID][subscription] = pendingMessage{consumer: consumer, msg: msg, settle: settle}
+	return
+}
+
+// RemovePendingMessages drops the messages of a consumer that is closed, the broker redelivers them
+func (p *PendingMessages) RemovePendingMessages(consumer pulsar.Consumer) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	for msgID, subscriptions := range p.pending {
+		for subscription, pending := range subscriptions {
+			if pending.consumer == consumer {
+				delete(subscriptions, subscription)
+			}
+		}
+		if len(subscriptions) == 0 {
+			delete(p.pending, msgID)
+		}
+	}
+}
+
+// RemovePendingMessage drops a held message so its handler can settle it, it reports false when
+// the message is not held, e.g. because the flow already acked it
+func (p *PendingMessages) RemovePendingMessage(msgID string, subscription string) bool {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	subscriptions := p.pending[msgID]
+	if _, ok := subscriptions[subscription]; !ok {
+		return false
+	}
+	delete(subscriptions, subscription)
+	if len(subscriptions) == 0 {
+		delete(p.pending, msgID)
+	}
+	return true
+}
+
+// AckMessage acks, or nacks when ack is false, a held message.  The subscription can be empty
+// unless the message is held for more than one subscription.
+func (p *PendingMessages) AckMessage(msgID string, subscription string, ack bool) error {
+	p.pendingMutex.Lock()
+	subscriptions := p.pending[msgID]
+	if subscription == "" && len(subscriptions) == 1 {
+		for name := range subscriptions {
+			subscription = name
+		}
+	}
+	pending, ok := subscriptions[subscription]
+	if !ok {
+		p.pendingMutex.Unlock()
+		if len(subscriptions) > 1 {
+			return fmt.Errorf("message %s is pending on %d subscriptions, the subscription is required", msgID, len(subscriptions))
+		}
+		return fmt.Errorf("message %s is not pending on subscription %s", msgID, subscription)
+	}
+	delete(subscriptions, subscription)
+	if len(subscriptions) == 0 {
+		delete(p.pending, msgID)
+	}
+	p.pendingMutex.Unlock()
+
+	if pending.settle != nil {
+		return pending.settle(ack)
+	}
+	if !ack {
+		pending.consumer.Nack(pending.msg)
+		return nil
+	}
+	return pending.consumer.Ack(pending.msg)
+}
@@ -0,0 +1,437 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	pulsarauth "github.com/apache/pulsar-client-go/pulsar/auth"
+)
+
+// AdminConnection is implemented by connection managers that offer a pulsar admin client
+type AdminConnection interface {
+	AdminClient() (*AdminClient, error)
+}
+
+// AdminClient is a client for the pulsar admin REST api (v2).  Topics are given as
+// [persistent|non-persistent://]tenant/namespace/topic, a bare topic name is in public/default.
+type AdminClient struct {
+	url        string
+	httpClient *http.Client
+}
+
+// AdminError is returned when the admin api answers with a non 2xx status
+type AdminError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *AdminError) Error() string {
+	return fmt.Sprintf("pulsar admin request failed with status %d: %s", e.StatusCode, e.Reason)
+}
+
+// TenantInfo describes a tenant
+type TenantInfo struct {
+	AdminRoles      []string `json:"adminRoles"`
+	AllowedClusters []string `json:"allowedClusters"`
+}
+
+// SchemaInfo describes the schema registered for a topic
+type SchemaInfo struct {
+	Version    int64             `json:"version,omitempty"`
+	Type       string            `json:"type"`
+	Schema     string            `json:"schema"`
+	Properties map[string]string `json:"properties"`
+}
+
+// NewAdminClient creates an admin client for the admin url, the transport adds authentication if needed
+func NewAdminClient(adminURL string, transport http.RoundTripper) *AdminClient {
+	return &AdminClient{
+		url:        strings.TrimSuffix(adminURL, "/"),
+		httpClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}
+}
+
+// AdminClient returns the admin client of the connection, it needs the adminUrl setting
+func (p *PulsarConnection) AdminClient() (*AdminClient, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.admin != nil {
+		return p.admin, nil
+	}
+	if p.settings == nil || p.settings.AdminURL == "" {
+		return nil, fmt.Errorf("pulsar connection has no adminUrl")
+	}
+	transport, err := newAdminTransport(p.settings)
+	if err != nil {
+		return nil, err
+	}
+	p.admin = NewAdminClient(p.settings.AdminURL, transport)
+	return p.admin, nil
+}
+
+// newAdminTransport builds an http transport with the connection's TLS settings and authentication
+func newAdminTransport(s *Settings) (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: s.AllowInsecure}
+	caBytes, err := getFileSetting(s.CaCert)
+	if err != nil {
+		return nil, err
+	}
+	if caBytes != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("cacert does not contain a pem certificate")
+		}
+	}
+	transport := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	auth, err := getAuthentication(s)
+	if err != nil || auth == nil {
+		return transport, err
+	}
+	provider := auth.(pulsarauth.Provider)
+	err = provider.Init()
+	if err != nil {
+		return nil, err
+	}
+	err = provider.WithTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// ListTenants lists the tenants of the cluster
+func (a *AdminClient) ListTenants() (tenants []string, err error) {
+	err = a.do(http.MethodGet, "/admin/v2/tenants", nil, &tenants)
+	return
+}
+
+// GetTenant returns the admin roles and allowed clusters of a tenant
+func (a *AdminClient) GetTenant(tenant string) (info *TenantInfo, err error) {
+	info = &TenantInfo{}
+	err = a.do(http.MethodGet, "/admin/v2/tenants/"+url.PathEscape(tenant), nil, info)
+	return
+}
+
+// CreateTenant creates a tenant
+func (a *AdminClient) CreateTenant(tenant string, info TenantInfo) error {
+	return a.do(http.MethodPut, "/admin/v2/tenants/"+url.PathEscape(tenant), info, nil)
+}
+
+// DeleteTenant deletes a tenant, it must not have namespaces
+func (a *AdminClient) DeleteTenant(tenant string) error {
+	return a.do(http.MethodDelete, "/admin/v2/tenants/"+url.PathEscape(tenant), nil, nil)
+}
+
+// ListNamespaces lists the namespaces of a tenant
+func (a *AdminClient) ListNamespaces(tenant string) (namespaces []string, err error) {
+	err = a.do(http.MethodGet, "/admin/v2/namespaces/"+url.PathEscape(tenant), nil, &namespaces)
+	return
+}
+
+// CreateNamespace creates a namespace given as tenant/namespace
+func (a *AdminClient) CreateNamespace(namespace string) error {
+	path, err := namespacePath(namespace)
+	if err != nil {
+		return err
+	}
+	return a.do(http.MethodPut, "/admin/v2/namespaces/"+path, nil, nil)
+}
+
+// DeleteNamespace deletes a namespace given as tenant/namespace
+func (a *AdminClient) DeleteNamespace(namespace string) error {
+	path, err := namespacePath(namespace)
+	if err != nil {
+		return err
+	}
+	return a.do(http.MethodDelete, "/admin/v2/namespaces/"+path, nil, nil)
+}
+
+// ListTopics lists the partitioned and the non-partitioned persistent topics of a namespace.
+// Partitions of partitioned topics are listed as non-partitioned topics by the broker.
+func (a *AdminClient) ListTopics(namespace string) (partitioned []string, nonPartitioned []string, err error) {
+	path, err := namespacePath(namespace)
+	if err != nil {
+		return
+	}
+	err = a.do(http.MethodGet, "/admin/v2/persistent/"+path+"/partitioned", nil, &partitioned)
+	if err != nil {
+		return
+	}
+	err = a.do(http.MethodGet, "/admin/v2/persistent/"+path, nil, &nonPartitioned)
+	return
+}
+
+// CreateTopic creates a topic, partitions greater than zero create a partitioned topic
+func (a *AdminClient) CreateTopic(topic string, partitions int) error {
+	path, err := topicPath(topic)
+	if err != nil {
+		return err
+	}
+	if partitions > 0 {
+		return a.do(http.MethodPut, "/admin/v2/"+path+"/partitions", partitions, nil)
+	}
+	return a.do(http.MethodPut, "/admin/v2/"+path, nil, nil)
+}
+
+// DeleteTopic deletes a topic, force deletes it even with active producers or subscriptions
+func (a *AdminClient) DeleteTopic(topic string, partitioned bool, force bool) error {
+	path, err := topicPath(topic)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		path += "/partitions"
+	}
+	return a.do(http.MethodDelete, "/admin/v2/"+path+"?force="+strconv.FormatBool(force), nil, nil)
+}
+
+// GetPartitions returns the number of partitions of a topic, 0 for a non-partitioned topic
+func (a *AdminClient) GetPartitions(topic string) (int, error) {
+	path, err := topicPath(topic)
+	if err != nil {
+		return 0, err
+	}
+	var metadata struct {
+		Partitions int `json:"partitions"`
+	}
+	err = a.do(http.MethodGet, "/admin/v2/"+path+"/partitions", nil, &metadata)
+	return metadata.Partitions, err
+}
+
+// TopicStats returns the stats of a topic
+func (a *AdminClient) TopicStats(topic string, partitioned bool) (stats map[string]interface{}, err error) {
+	path, err := topicPath(topic)
+	if err != nil {
+		return
+	}
+	if partitioned {
+		err = a.do(http.MethodGet, "/admin/v2/"+path+"/partitioned-stats", nil, &stats)
+	} else {
+		err = a.do(http.MethodGet, "/admin/v2/"+path+"/stats", nil, &stats)
+	}
+	return
+}
+
+// TopicInternalStats returns the managed ledger stats of a topic
+func (a *AdminClient) TopicInternalStats(topic string, partitioned bool) (stats map[string]interface{}, err error) {
+	path, err := topicPath(topic)
+	if err != nil {
+		return
+	}
+	if partitioned {
+		err = a.do(http.MethodGet, "/admin/v2/"+path+"/partitioned-internalStats", nil, &stats)
+	} else {
+		err = a.do(http.MethodGet, "/admin/v2/"+path+"/internalStats", nil, &stats)
+	}
+	return
+}
+
+// ListSubscriptions lists the subscriptions of a topic
+func (a *AdminClient) ListSubscriptions(topic string) (subscriptions []string, err error) {
+	path, err := topicPath(topic)
+	if err != nil {
+		return
+	}
+	err = a.do(http.MethodGet, "/admin/v2/"+path+"/subscriptions", nil, &subscriptions)
+	return
+}
+
+// CreateSubscription creates a subscription positioned at the "Earliest" or "Latest" message
+func (a *AdminClient) CreateSubscription(topic string, subscription string, position string) error {
+	path, err := subscriptionPath(topic, subscription)
+	if err != nil {
+		return err
+	}
+	messageID := map[string]int64{"ledgerId": math.MaxInt64, "entryId": math.MaxInt64}
+	if position == "Earliest" {
+		messageID = map[string]int64{"ledgerId": -1, "entryId": -1}
+	}
+	return a.do(http.MethodPut, "/admin/v2/"+path, messageID, nil)
+}
+
+// DeleteSubscription deletes a subscription, force disconnects its consumers first
+func (a *AdminClient) DeleteSubscription(topic string, subscription string, force bool) error {
+	path, err := subscriptionPath(topic, subscription)
+	if err != nil {
+		return err
+	}
+	return a.do(http.MethodDelete, "/admin/v2/"+path+"?force="+strconv.FormatBool(force), nil, nil)
+}
+
+// ResetSubscription moves the cursor of a subscription back or forward to a publish time
+func (a *AdminClient) ResetSubscription(topic string, subscription string, timestamp time.Time) error {
+	path, err := subscriptionPath(topic, subscription)
+	if err != nil {
+		return err
+	}
+	millis := strconv.FormatInt(timestamp.UnixNano()/int64(time.Millisecond), 10)
+	return a.do(http.MethodPost, "/admin/v2/"+path+"/resetcursor/"+millis, nil, nil)
+}
+
+// SkipMessages skips messages in the backlog of a subscription
+func (a *AdminClient) SkipMessages(topic string, subscription string, count int) error {
+	path, err := subscriptionPath(topic, subscription)
+	if err != nil {
+		return err
+	}
+	return a.do(http.MethodPost, "/admin/v2/"+path+"/skip/"+strconv.Itoa(count), nil, nil)
+}
+
+// ClearBacklog skips all messages in the backlog of a subscription
+func (a *AdminClient) ClearBacklog(topic string, subscription string) error {
+	path, err := subscriptionPath(topic, subscription)
+	if err != nil {
+		return err
+	}
+	return a.do(http.MethodPost, "/admin/v2/"+path+"/skip_all", nil, nil)
+}
+
+// GetSchema returns the latest schema registered for a topic
+func (a *AdminClient) GetSchema(topic string) (schema *SchemaInfo, err error) {
+	path, err := schemaPath(topic)
+	if err != nil {
+		return
+	}
+	schema = &SchemaInfo{}
+	err = a.do(http.MethodGet, "/admin/v2/schemas/"+path, nil, schema)
+	return
+}
+
+// GetSchemaVersion returns a version of the schema registered for a topic
+func (a *AdminClient) GetSchemaVersion(topic string, version int64) (schema *SchemaInfo, err error) {
+	path, err := schemaPath(topic)
+	if err != nil {
+		return
+	}
+	schema = &SchemaInfo{}
+	err = a.do(http.MethodGet, "/admin/v2/schemas/"+path+"/"+strconv.FormatInt(version, 10), nil, schema)
+	return
+}
+
+// CreateSchema registers a new schema version for a topic
+func (a *AdminClient) CreateSchema(topic string, schema SchemaInfo) error {
+	path, err := schemaPath(topic)
+	if err != nil {
+		return err
+	}
+	schema.Version = 0
+	return a.do(http.MethodPost, "/admin/v2/schemas/"+path, schema, nil)
+}
+
+// DeleteSchema deletes all schema versions of a topic
+func (a *AdminClient) DeleteSchema(topic string) error {
+	path, err := schemaPath(topic)
+	if err != nil {
+		return err
+	}
+	return a.do(http.MethodDelete, "/admin/v2/schemas/"+path, nil, nil)
+}
+
+func (a *AdminClient) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		inBytes, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(inBytes)
+	}
+	req, err := http.NewRequest(method, a.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	logger.Debugf("pulsar admin request: %s %s", method, path)
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		adminErr := &AdminError{StatusCode: resp.StatusCode, Reason: strings.TrimSpace(string(respBytes))}
+		var reason struct {
+			Reason string `json:"reason"`
+		}
+		if json.Unmarshal(respBytes, &reason) == nil && reason.Reason != "" {
+			adminErr.Reason = reason.Reason
+		}
+		return adminErr
+	}
+	if out == nil || len(respBytes) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBytes, out)
+}
+
+func namespacePath(namespace string) (string, error) {
+	parts := strings.Split(namespace, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid namespace %s, expected tenant/namespace", namespace)
+	}
+	return url.PathEscape(parts[0]) + "/" + url.PathEscape(parts[1]), nil
+}
+
+// topicPath returns domain/tenant/namespace/topic for a topic name
+func topicPath(topic string) (string, error) {
+	domain := "persistent"
+	if i := strings.Index(topic, "://"); i >= 0 {
+		domain = topic[:i]
+		topic = topic[i+3:]
+	}
+	if domain != "persistent" && domain != "non-persistent" {
+		return "", fmt.Errorf("invalid topic domain %s", domain)
+	}
+	parts := strings.Split(topic, "/")
+	switch len(parts) {
+	case 1:
+		parts = []string{"public", "default", parts[0]}
+	case 3:
+	default:
+		return "", fmt.Errorf("invalid topic %s, expected tenant/namespace/topic", topic)
+	}
+	for i, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("invalid topic %s, expected tenant/namespace/topic", topic)
+		}
+		parts[i] = url.PathEscape(part)
+	}
+	return domain + "/" + strings.Join(parts, "/"), nil
+}
+
+func subscriptionPath(topic string, subscription string) (string, error) {
+	if subscription == "" {
+		return "", fmt.Errorf("subscription name is required")
+	}
+	path, err := topicPath(topic)
+	if err != nil {
+		return "", err
+	}
+	return path + "/subscription/" + url.PathEscape(subscription), nil
+}
+
+// schemaPath returns tenant/namespace/topic/schema, schemas are shared by both topic domains
+func schemaPath(topic string) (string, error) {
+	path, err := topicPath(topic)
+	if err != nil {
+		return "", err
+	}
+	return path[strings.Index(path, "/")+1:] + "/schema", nil
+}
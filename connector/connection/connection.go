@@ -1,14 +1,19 @@
 package connection
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
+	pulsarauth "github.com/apache/pulsar-client-go/pulsar/auth"
 	"github.com/project-flogo/core/data/metadata"
 	"github.com/project-flogo/core/support/connection"
 	"github.com/project-flogo/core/support/log"
@@ -23,24 +28,69 @@ func init() {
 
 // Settings comment
 type Settings struct {
-	Name          string `md:"name,required"`
-	URL           string `md:"url,required"`
-	CaCert        string `md:"cacert"`
-	Auth          string `md:"auth"`
-	CertFile      string `md:"certFile"`
-	KeyFile       string `md:"keyFile"`
-	JWT           string `md:"jwt"`
-	AllowInsecure bool   `md:"allowinsecure"`
+	Name           string `md:"name,required"`
+	URL            string `md:"url,required"`
+	CaCert         string `md:"cacert"`
+	Auth           string `md:"auth"`
+	CertFile       string `md:"certFile"`
+	KeyFile        string `md:"keyFile"`
+	JWT            string `md:"jwt"`
+	JWTFile        string `md:"jwtFile"`
+	JWTEnv         string `md:"jwtEnv"`
+	JWTCommand     string `md:"jwtCommand"`
+	AllowInsecure  bool   `md:"allowinsecure"`
+	IssuerURL      string `md:"issuerUrl"`
+	Audience       string `md:"audience"`
+	ClientID       string `md:"clientId"`
+	Scope          string `md:"scope"`
+	PrivateKey     string `md:"privateKey"`
+	ProviderDomain string `md:"providerDomain"`
+	TenantDomain   string `md:"tenantDomain"`
+	TenantService  string `md:"tenantService"`
+	KeyID          string `md:"keyId"`
+	ZtsURL         string `md:"ztsUrl"`
+
+	ConnectionTimeout       int    `md:"connectionTimeout"`
+	OperationTimeout        int    `md:"operationTimeout"`
+	MaxConnectionsPerBroker int    `md:"maxConnectionsPerBroker"`
+	TLSValidateHostname     bool   `md:"tlsValidateHostname"`
+	ListenerName            string `md:"listenerName"`
+
+	ProbeTopic          string `md:"probeTopic"`
+	HealthCheckInterval int    `md:"healthCheckInterval"`
+	FailoverURLs        string `md:"failoverUrls"`
+
+	AdminURL string `md:"adminUrl"`
 }
 
-// AthenzAuthentication string `md:"athenzauth"`
+// health check interval used when failover urls are configured without one
+const defaultFailoverCheckInterval = 30
+
+// how long Stop waits for producers and consumers to release the client before closing it
+var stopDrainTimeout = 10 * time.Second
 
 // PulsarConnection comment
 type PulsarConnection struct {
-	client      pulsar.Client
-	keystoreDir string
-	clientOpts  pulsar.ClientOptions
-	settings    *Settings
+	mutex          sync.Mutex
+	client         pulsar.Client
+	activeIndex    int
+	retired        map[pulsar.Client]bool
+	listeners      map[int]ClientListener
+	nextListener   int
+	refs           int
+	stopped        bool
+	keystoreDir    string
+	trustCertsFile string
+	clientOpts     pulsar.ClientOptions
+	settings       *Settings
+	admin          *AdminClient
+
+	healthMutex sync.Mutex
+	healthy     bool
+	healthKnown bool
+	healthDone  chan struct{}
+
+	PendingMessages
 }
 
 // Factory comment
@@ -59,39 +109,28 @@ func (*Factory) NewManager(settings map[string]interface{}) (connection.Manager,
 	if err != nil {
 		return nil, err
 	}
-	var auth pulsar.Authentication
-	keystoreDir, err := createTempKeystoreDir(s)
+	auth, err := getAuthentication(s)
 	if err != nil {
 		return nil, err
 	}
-
-	if s.Auth == "TLS" {
-		auth, err = getTLSAuthentication(keystoreDir, s)
-		if err != nil {
-			return nil, err
-		}
-	} else if s.Auth == "JWT" {
-		auth, err = getJWTAuthentication(s)
-		if err != nil {
-			return nil, err
-		}
+	if s.ConnectionTimeout < 0 || s.OperationTimeout < 0 || s.MaxConnectionsPerBroker < 0 || s.HealthCheckInterval < 0 {
+		return nil, fmt.Errorf("connectionTimeout, operationTimeout, maxConnectionsPerBroker and healthCheckInterval can not be negative")
+	}
+	if s.FailoverURLs != "" && s.HealthCheckInterval == 0 {
+		s.HealthCheckInterval = defaultFailoverCheckInterval
 	}
 	clientOpts := pulsar.ClientOptions{
 		URL:                        s.URL,
 		Authentication:             auth,
-		TLSValidateHostname:        false,
+		ConnectionTimeout:          time.Duration(s.ConnectionTimeout) * time.Second,
+		OperationTimeout:           time.Duration(s.OperationTimeout) * time.Second,
+		MaxConnectionsPerBroker:    s.MaxConnectionsPerBroker,
+		TLSValidateHostname:        s.TLSValidateHostname,
 		TLSAllowInsecureConnection: s.AllowInsecure,
+		ListenerName:               s.ListenerName,
+		Logger:                     newClientLogger(log.ChildLogger(logger, "client")),
 	}
-	if strings.Index(s.URL, "pulsar+ssl") >= 0 {
-		clientOpts.TLSTrustCertsFilePath = keystoreDir + string(os.PathSeparator) + "cacert.pem"
-	}
-	logger.Debugf("pulsar.ClientOptions: %v", clientOpts)
-
-	client, err := pulsar.NewClient(clientOpts)
-	if err != nil {
-		return nil, err
-	}
-	return &PulsarConnection{client: client, keystoreDir: keystoreDir, clientOpts: clientOpts, settings: s}, nil
+	return &PulsarConnection{clientOpts: clientOpts, settings: s}, nil
 }
 
 // Type comment
@@ -99,113 +138,292 @@ func (p *PulsarConnection) Type() string {
 	return "pulsar"
 }
 
-// GetConnection comment
+// GetConnection returns the shared pulsar.Client, creating it on first use.  Every caller
+// holds a reference and must hand the client back with ReleaseConnection.
 func (p *PulsarConnection) GetConnection() interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.settings == nil || p.stopped {
+		return nil
+	}
+	if p.client == nil {
+		err := p.createClient()
+		if err != nil {
+			logger.Errorf("could not create pulsar client for connection %s: %v", p.settings.Name, err)
+			return nil
+		}
+	}
+	p.refs++
+	logger.Debugf("PulsarConnection.GetConnection() references: %d", p.refs)
 	return p.client
 }
 
-// Stop comment
+// Stop waits for producers and consumers to release the client, then closes it
 func (p *PulsarConnection) Stop() error {
-	// logger.Debugf("PulsarConnection.Stop()")
-	// p.client.Close()
-	// os.RemoveAll(p.keystoreDir)
+	logger.Debugf("PulsarConnection.Stop()")
+	deadline := time.Now().Add(stopDrainTimeout)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stopped = true
+	for p.refs > 0 && time.Now().Before(deadline) {
+		p.mutex.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		p.mutex.Lock()
+	}
+	if p.refs > 0 {
+		logger.Warnf("closing pulsar client with %d producers or consumers still open", p.refs)
+		p.refs = 0
+	}
+	p.closeClient()
 	return nil
 }
 
-// Start comment
+// Start allows the client to be created again after a Stop, the client itself is created
+// by the next GetConnection
 func (p *PulsarConnection) Start() (err error) {
 	logger.Debugf("PulsarConnection.Start()")
-	// p.keystoreDir, _, err = getAuthentication(p.settings)
-	// if err != nil {
-	// 	return
-	// }
-	// logger.Debugf("PulsarConnection.Start KeystoreDir: %s", p.keystoreDir)
-
-	// p.client, err = pulsar.NewClient(p.clientOpts)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stopped = false
 	return
 }
 
-// ReleaseConnection comment
+// ReleaseConnection drops a reference taken by GetConnection, the client is closed
+// when the last reference is released
 func (p *PulsarConnection) ReleaseConnection(connection interface{}) {
-	logger.Debugf("PulsarConnection.ReleaseConnection()")
-	p.Stop()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if connection == nil || p.client == nil {
+		logger.Debugf("PulsarConnection.ReleaseConnection() called with a stale client")
+		return
+	}
+	if client, ok := connection.(pulsar.Client); !ok || (client != p.client && !p.retired[client]) {
+		logger.Debugf("PulsarConnection.ReleaseConnection() called with a stale client")
+		return
+	}
+	p.refs--
+	logger.Debugf("PulsarConnection.ReleaseConnection() references: %d", p.refs)
+	if p.refs <= 0 {
+		p.refs = 0
+		p.closeClient()
+	}
 }
 
-func getTLSAuthentication(keystoreDir string, s *Settings) (auth pulsar.Authentication, err error) {
-	auth = pulsar.NewAuthenticationTLS(keystoreDir+string(os.PathSeparator)+"certfile.pem",
-		keystoreDir+string(os.PathSeparator)+"keyfile.pem")
+func (p *PulsarConnection) createClient() (err error) {
+	if strings.Contains(p.settings.URL+p.settings.FailoverURLs, "pulsar+ssl") && p.settings.CaCert != "" {
+		p.keystoreDir, p.trustCertsFile, err = createTrustCertsFile(p.settings)
+		if err != nil {
+			return
+		}
+	}
+	p.client, err = p.newClient(p.settings.URL)
+	if err != nil {
+		removeKeystoreDir(p.keystoreDir)
+		p.keystoreDir = ""
+		return
+	}
+	p.activeIndex = 0
+	if p.settings.HealthCheckInterval > 0 {
+		p.healthDone = make(chan struct{})
+		go p.healthLoop(p.healthDone)
+	}
+	return
+}
+
+func (p *PulsarConnection) newClient(url string) (pulsar.Client, error) {
+	clientOpts := p.clientOpts
+	clientOpts.URL = url
+	if strings.Contains(url, "pulsar+ssl") {
+		clientOpts.TLSTrustCertsFilePath = p.trustCertsFile
+	}
+	logger.Debugf("pulsar.ClientOptions: %v", clientOpts)
+	return pulsar.NewClient(clientOpts)
+}
+
+func (p *PulsarConnection) closeClient() {
+	if p.healthDone != nil {
+		close(p.healthDone)
+		p.healthDone = nil
+	}
+	if p.client != nil {
+		logger.Debugf("closing pulsar client for connection %s", p.settings.Name)
+		p.client.Close()
+		p.client = nil
+	}
+	p.retired = nil
+	removeKeystoreDir(p.keystoreDir)
+	p.keystoreDir = ""
+	p.trustCertsFile = ""
+}
+
+// getAuthentication returns the provider for the auth setting, or nil when auth is None
+func getAuthentication(s *Settings) (auth pulsar.Authentication, err error) {
+	if s.Auth == "TLS" {
+		auth, err = getTLSAuthentication(s)
+	} else if s.Auth == "JWT" {
+		auth, err = getJWTAuthentication(s)
+	} else if s.Auth == "OAuth2" {
+		auth, err = getOAuth2Authentication(s)
+	} else if s.Auth == "Athenz" {
+		auth, err = getAthenzAuthentication(s)
+	}
+	return
+}
+
+// getTLSAuthentication parses the client certificate and key once and hands the in memory
+// key pair to the client, no pem is written to disk.
+func getTLSAuthentication(s *Settings) (auth pulsar.Authentication, err error) {
+	certBytes, err := getFileSetting(s.CertFile)
+	if err != nil {
+		return
+	}
+	keyBytes, err := getFileSetting(s.KeyFile)
+	if err != nil {
+		return
+	}
+	if certBytes == nil || keyBytes == nil {
+		return nil, fmt.Errorf("tls authentication requires a certFile and a keyFile")
+	}
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls client certificate or key: [%s]", err)
+	}
+	auth = pulsar.NewAuthenticationFromTLSCertSupplier(func() (*tls.Certificate, error) {
+		return &cert, nil
+	})
 	return
 }
 func getJWTAuthentication(s *Settings) (auth pulsar.Authentication, err error) {
-	auth = pulsar.NewAuthenticationToken(s.JWT)
+	supplier, err := newTokenSupplier(s)
+	if err != nil {
+		return
+	}
+	if supplier == nil {
+		auth = pulsar.NewAuthenticationToken(s.JWT)
+		return
+	}
+	auth = pulsar.NewAuthenticationTokenFromSupplier(supplier.getToken)
 	return
 }
 
-func createTempKeystoreDir(s *Settings) (keystoreDir string, err error) {
-	var certObj, keyObj, cacertObj map[string]interface{}
-	logger.Debugf("createTempCertificateDir:  %v", *s)
-	if s.CertFile != "" || s.KeyFile != "" || s.CaCert != "" {
-		keystoreDir, err = ioutil.TempDir(os.TempDir(), s.Name)
-		if err != nil {
-			return
-		}
-	} else {
-		return "", nil
+// getOAuth2Authentication builds a client credentials provider. The credentials file is the
+// standard pulsar/StreamNative key file; issuerUrl and clientId settings override its values.
+// The provider caches the access token and fetches a new one from the issuer before it expires.
+func getOAuth2Authentication(s *Settings) (auth pulsar.Authentication, err error) {
+	keyFile := make(map[string]interface{})
+	keyBytes, err := getFileSetting(s.PrivateKey)
+	if err != nil {
+		return
 	}
-	if s.CaCert != "" {
-		err = json.Unmarshal([]byte(s.CaCert), &cacertObj)
-		if err != nil {
-			return
-		}
-		var certBytes []byte
-		certBytes, err = getBytesFromFileSetting(cacertObj)
+	if keyBytes != nil {
+		err = json.Unmarshal(keyBytes, &keyFile)
 		if err != nil {
-			return
-		}
-		if certBytes != nil {
-			err = ioutil.WriteFile(keystoreDir+string(os.PathSeparator)+"cacert.pem", certBytes, 0644)
-			if err != nil {
-				return
-			}
+			return nil, fmt.Errorf("oauth2 credentials file is not valid json: [%s]", err)
 		}
 	}
-	if s.CertFile != "" {
-		err = json.Unmarshal([]byte(s.CertFile), &certObj)
-		if err != nil {
-			return
-		}
-		var certBytes []byte
-		certBytes, err = getBytesFromFileSetting(certObj)
-		if err != nil {
-			return
-		}
-		if certBytes != nil {
-			err = ioutil.WriteFile(keystoreDir+string(os.PathSeparator)+"certfile.pem", certBytes, 0644)
-			if err != nil {
-				return
-			}
-		}
+	if s.IssuerURL != "" {
+		keyFile["issuer_url"] = s.IssuerURL
 	}
-	if s.KeyFile != "" {
-		err = json.Unmarshal([]byte(s.KeyFile), &keyObj)
-		if err != nil {
-			return
-		}
-		var keyBytes []byte
-		keyBytes, err = getBytesFromFileSetting(keyObj)
-		if err != nil {
-			return
-		}
-		if keyBytes != nil {
-			err = ioutil.WriteFile(keystoreDir+string(os.PathSeparator)+"keyfile.pem", keyBytes, 0644)
-			if err != nil {
-				return
-			}
-		}
+	if s.ClientID != "" {
+		keyFile["client_id"] = s.ClientID
+	}
+	issuerURL, _ := keyFile["issuer_url"].(string)
+	clientID, _ := keyFile["client_id"].(string)
+	if issuerURL == "" || clientID == "" {
+		return nil, fmt.Errorf("oauth2 authentication requires an issuer url and a client id")
+	}
+	keyBytes, err = json.Marshal(keyFile)
+	if err != nil {
+		return
+	}
+	params := map[string]string{
+		"type":       "client_credentials",
+		"issuerUrl":  issuerURL,
+		"audience":   s.Audience,
+		"clientId":   clientID,
+		"privateKey": "data:application/json;base64," + base64.StdEncoding.EncodeToString(keyBytes),
+	}
+	if s.Scope != "" {
+		params["scope"] = s.Scope
+	}
+	auth, err = pulsarauth.NewAuthenticationOAuth2WithParams(params)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2 authentication failed: [%s]", err)
+	}
+	return
+}
+
+// getAthenzAuthentication builds an Athenz role token provider. The tenant private key is
+// handed to the provider as a data url so the pem never touches the disk.
+func getAthenzAuthentication(s *Settings) (auth pulsar.Authentication, err error) {
+	if s.ProviderDomain == "" || s.TenantDomain == "" || s.TenantService == "" || s.ZtsURL == "" {
+		return nil, fmt.Errorf("athenz authentication requires providerDomain, tenantDomain, tenantService and ztsUrl")
+	}
+	keyBytes, err := getFileSetting(s.PrivateKey)
+	if err != nil {
+		return
+	}
+	if keyBytes == nil {
+		return nil, fmt.Errorf("athenz authentication requires a privateKey")
+	}
+	params := map[string]string{
+		"providerDomain": s.ProviderDomain,
+		"tenantDomain":   s.TenantDomain,
+		"tenantService":  s.TenantService,
+		"privateKey":     "data:application/x-pem-file;base64," + base64.StdEncoding.EncodeToString(keyBytes),
+		"keyId":          s.KeyID,
+		"ztsUrl":         s.ZtsURL,
+	}
+	auth, err = pulsarauth.NewAuthenticationAthenzWithParams(params)
+	if err != nil {
+		return nil, fmt.Errorf("athenz authentication failed: [%s]", err)
 	}
 	return
 }
 
+// createTrustCertsFile writes the CA certificate to a private temp dir, the client only accepts
+// trusted certs as a file path.  The dir is removed when the connection is stopped.
+func createTrustCertsFile(s *Settings) (keystoreDir string, trustCertsFile string, err error) {
+	caBytes, err := getFileSetting(s.CaCert)
+	if err != nil || caBytes == nil {
+		return
+	}
+	keystoreDir, err = ioutil.TempDir(os.TempDir(), s.Name)
+	if err != nil {
+		return
+	}
+	trustCertsFile = filepath.Join(keystoreDir, "cacert.pem")
+	err = ioutil.WriteFile(trustCertsFile, caBytes, 0600)
+	if err != nil {
+		removeKeystoreDir(keystoreDir)
+		return "", "", err
+	}
+	return
+}
+
+func removeKeystoreDir(keystoreDir string) {
+	if keystoreDir == "" {
+		return
+	}
+	err := os.RemoveAll(keystoreDir)
+	if err != nil {
+		logger.Warnf("could not remove keystore dir %s: %v", keystoreDir, err)
+	}
+}
+
+// getFileSetting returns the decoded content of a file based setting, or nil when it is empty
+func getFileSetting(setting string) ([]byte, error) {
+	if setting == "" {
+		return nil, nil
+	}
+	var fileSetting map[string]interface{}
+	err := json.Unmarshal([]byte(setting), &fileSetting)
+	if err != nil {
+		return nil, err
+	}
+	return getBytesFromFileSetting(fileSetting)
+}
+
 func getBytesFromFileSetting(fileSetting map[string]interface{}) (destArray []byte, err error) {
 	var header = "base64,"
 	value := fileSetting["content"].(string)
@@ -0,0 +1,547 @@
+package connection
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	pulsarauth "github.com/apache/pulsar-client-go/pulsar/auth"
+	pulsarlog "github.com/apache/pulsar-client-go/pulsar/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func fileSetting(name string, content []byte) string {
+	setting, _ := json.Marshal(map[string]string{
+		"filename": name,
+		"content":  "data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(content),
+	})
+	return string(setting)
+}
+
+func newTokenServer(t *testing.T) (*httptest.Server, *int32) {
+	var issued int32
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":         server.URL,
+			"token_endpoint": server.URL + "/oauth/token",
+		})
+	})
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "test-client", r.PostForm.Get("client_id"))
+		assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+		assert.Equal(t, "urn:pulsar:test", r.PostForm.Get("audience"))
+		n := atomic.AddInt32(&issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		// expires_in is inside the refresh window so every request fetches a new token
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", n),
+			"token_type":   "Bearer",
+			"expires_in":   30,
+		})
+	})
+	return server, &issued
+}
+
+func TestOAuth2Authentication(t *testing.T) {
+	server, issued := newTokenServer(t)
+	defer server.Close()
+
+	keyFile, _ := json.Marshal(map[string]string{
+		"type":          "client_credentials",
+		"client_id":     "test-client",
+		"client_secret": "secret",
+		"issuer_url":    "http://unused.invalid",
+	})
+	s := &Settings{
+		Auth:       "OAuth2",
+		IssuerURL:  server.URL,
+		Audience:   "urn:pulsar:test",
+		PrivateKey: fileSetting("credentials.json", keyFile),
+	}
+	auth, err := getOAuth2Authentication(s)
+	assert.Nil(t, err)
+	provider := auth.(pulsarauth.Provider)
+	assert.Nil(t, provider.Init())
+
+	token, err := provider.GetData()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-2", string(token))
+
+	token, err = provider.GetData()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-3", string(token))
+	assert.Equal(t, int32(3), atomic.LoadInt32(issued))
+}
+
+func TestOAuth2AuthenticationMissingIssuer(t *testing.T) {
+	s := &Settings{Auth: "OAuth2", ClientID: "test-client"}
+	_, err := getOAuth2Authentication(s)
+	assert.NotNil(t, err)
+}
+
+func TestAthenzAuthentication(t *testing.T) {
+	var principal string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = r.Header.Get("Athenz-Principal-Auth")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      "role-token",
+			"expiryTime": time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	s := &Settings{
+		Auth:           "Athenz",
+		ProviderDomain: "pulsar",
+		TenantDomain:   "tenant.domain",
+		TenantService:  "service",
+		PrivateKey:     fileSetting("tenant.pem", keyPem),
+		KeyID:          "1",
+		ZtsURL:         server.URL,
+	}
+	auth, err := getAthenzAuthentication(s)
+	assert.Nil(t, err)
+	provider := auth.(pulsarauth.Provider)
+	assert.Nil(t, provider.Init())
+
+	token, err := provider.GetData()
+	assert.Nil(t, err)
+	assert.Equal(t, "role-token", string(token))
+	assert.Contains(t, principal, "d=tenant.domain;n=service")
+	assert.Contains(t, principal, "k=1")
+}
+
+func TestAthenzAuthenticationMissingSettings(t *testing.T) {
+	s := &Settings{Auth: "Athenz", TenantDomain: "tenant.domain"}
+	_, err := getAthenzAuthentication(s)
+	assert.NotNil(t, err)
+}
+
+func testToken(subject string, expiry time.Time) string {
+	claims, _ := json.Marshal(map[string]interface{}{"sub": subject, "exp": expiry.Unix()})
+	return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(claims) + ".c2lnbmF0dXJl"
+}
+
+func TestJWTFromFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	expired := testToken("first", time.Now().Add(-time.Minute))
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte(expired+"\n"), 0600))
+
+	supplier, err := newTokenSupplier(&Settings{Auth: "JWT", JWTFile: tokenFile})
+	assert.Nil(t, err)
+	token, err := supplier.getToken()
+	assert.Nil(t, err)
+	assert.Equal(t, expired, token)
+
+	// an expired token is read again from the rotated file
+	rotated := testToken("second", time.Now().Add(time.Hour))
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte(rotated), 0600))
+	token, err = supplier.getToken()
+	assert.Nil(t, err)
+	assert.Equal(t, rotated, token)
+
+	// a valid token is served from the cache
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte(testToken("third", time.Now().Add(time.Hour))), 0600))
+	token, err = supplier.getToken()
+	assert.Nil(t, err)
+	assert.Equal(t, rotated, token)
+}
+
+func TestJWTFromEnvAndCommand(t *testing.T) {
+	t.Setenv("PULSAR_TEST_JWT", "env-token")
+	supplier, err := newTokenSupplier(&Settings{Auth: "JWT", JWTEnv: "PULSAR_TEST_JWT"})
+	assert.Nil(t, err)
+	token, err := supplier.getToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "env-token", token)
+
+	supplier, err = newTokenSupplier(&Settings{Auth: "JWT", JWTCommand: "echo command-token"})
+	assert.Nil(t, err)
+	token, err = supplier.getToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "command-token", token)
+
+	// a hung command does not block the client
+	supplier, err = newTokenSupplier(&Settings{Auth: "JWT", JWTCommand: "sleep 10"})
+	assert.Nil(t, err)
+	supplier.timeout = 100 * time.Millisecond
+	started := time.Now()
+	_, err = supplier.getToken()
+	assert.EqualError(t, err, "jwt token command sleep did not finish within 100ms")
+	assert.Less(t, time.Since(started), 5*time.Second)
+
+	_, err = newTokenSupplier(&Settings{Auth: "JWT", JWTEnv: "PULSAR_TEST_JWT", JWTFile: "/tmp/token"})
+	assert.NotNil(t, err)
+}
+
+func testCertificate(t *testing.T) (certPem []byte, keyPem []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pulsar-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return
+}
+
+func TestTLSAuthenticationInMemory(t *testing.T) {
+	certPem, keyPem := testCertificate(t)
+	s := &Settings{
+		Auth:     "TLS",
+		CertFile: fileSetting("cert.pem", certPem),
+		KeyFile:  fileSetting("key.pem", keyPem),
+	}
+	auth, err := getTLSAuthentication(s)
+	assert.Nil(t, err)
+	cert, err := auth.(pulsarauth.Provider).GetTLSCertificate()
+	assert.Nil(t, err)
+	assert.NotNil(t, cert)
+	assert.NotEmpty(t, cert.Certificate)
+
+	s.KeyFile = fileSetting("key.pem", []byte("not a key"))
+	_, err = getTLSAuthentication(s)
+	assert.NotNil(t, err)
+}
+
+func TestTrustCertsFile(t *testing.T) {
+	certPem, _ := testCertificate(t)
+	s := &Settings{Name: "trust-test", CaCert: fileSetting("ca.pem", certPem)}
+	keystoreDir, trustCertsFile, err := createTrustCertsFile(s)
+	assert.Nil(t, err)
+	info, err := os.Stat(trustCertsFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	removeKeystoreDir(keystoreDir)
+	_, err = os.Stat(keystoreDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConnectionLifecycle(t *testing.T) {
+	stopDrainTimeout = 200 * time.Millisecond
+	factory := &Factory{}
+	manager, err := factory.NewManager(map[string]interface{}{
+		"name": "lifecycle",
+		"url":  "pulsar://localhost:6650",
+	})
+	assert.Nil(t, err)
+	pulsarConn := manager.(*PulsarConnection)
+	assert.Nil(t, pulsarConn.client)
+
+	first := manager.GetConnection()
+	second := manager.GetConnection()
+	assert.NotNil(t, first)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 2, pulsarConn.refs)
+
+	manager.ReleaseConnection(first)
+	assert.NotNil(t, pulsarConn.client)
+	manager.ReleaseConnection(second)
+	assert.Nil(t, pulsarConn.client)
+
+	third := manager.GetConnection()
+	assert.NotNil(t, third)
+	assert.Nil(t, pulsarConn.Stop())
+	assert.Nil(t, pulsarConn.client)
+	assert.Nil(t, manager.GetConnection())
+
+	// releasing a client closed by Stop is a no-op
+	manager.ReleaseConnection(third)
+	assert.Nil(t, pulsarConn.Start())
+	assert.NotNil(t, manager.GetConnection())
+	assert.Nil(t, pulsarConn.Stop())
+}
+
+func TestClientOptions(t *testing.T) {
+	factory := &Factory{}
+	manager, err := factory.NewManager(map[string]interface{}{
+		"name":                    "options",
+		"url":                     "pulsar://localhost:6650",
+		"connectionTimeout":       3,
+		"operationTimeout":        20,
+		"maxConnectionsPerBroker": 4,
+		"tlsValidateHostname":     true,
+		"listenerName":            "external",
+	})
+	assert.Nil(t, err)
+	opts := manager.(*PulsarConnection).clientOpts
+	assert.Equal(t, 3*time.Second, opts.ConnectionTimeout)
+	assert.Equal(t, 20*time.Second, opts.OperationTimeout)
+	assert.Equal(t, 4, opts.MaxConnectionsPerBroker)
+	assert.True(t, opts.TLSValidateHostname)
+	assert.Equal(t, "external", opts.ListenerName)
+	assert.NotNil(t, opts.Logger)
+	opts.Logger.SubLogger(pulsarlog.Fields{"topic": "t"}).WithField("partition", 1).Debugf("bridged %d", 1)
+
+	_, err = factory.NewManager(map[string]interface{}{
+		"name":             "options",
+		"url":              "pulsar://localhost:6650",
+		"operationTimeout": -1,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestHealthCheck(t *testing.T) {
+	factory := &Factory{}
+	manager, err := factory.NewManager(map[string]interface{}{
+		"name":              "health",
+		"url":               "pulsar://127.0.0.1:1",
+		"operationTimeout":  1,
+		"connectionTimeout": 1,
+	})
+	assert.Nil(t, err)
+	checker, ok := manager.(HealthChecker)
+	assert.True(t, ok)
+	assert.NotNil(t, checker.HealthCheck())
+
+	client := manager.GetConnection()
+	defer manager.ReleaseConnection(client)
+	recorder := httptest.NewRecorder()
+	manager.(http.Handler).ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "flogo-healthcheck")
+}
+
+func TestFailoverSwitchClient(t *testing.T) {
+	factory := &Factory{}
+	manager, err := factory.NewManager(map[string]interface{}{
+		"name":         "failover",
+		"url":          "pulsar://primary:6650",
+		"failoverUrls": "pulsar://standby1:6650; pulsar://standby2:6650",
+	})
+	assert.Nil(t, err)
+	pulsarConn := manager.(*PulsarConnection)
+	assert.Equal(t, []string{"pulsar://primary:6650", "pulsar://standby1:6650", "pulsar://standby2:6650"}, pulsarConn.serviceURLs())
+	assert.Equal(t, defaultFailoverCheckInterval, pulsarConn.settings.HealthCheckInterval)
+
+	// create the primary client without the background health loop
+	pulsarConn.settings.HealthCheckInterval = 0
+	primary := manager.GetConnection().(pulsar.Client)
+	var switched pulsar.Client
+	remove := pulsarConn.AddClientListener(func(client pulsar.Client) {
+		switched = client
+	})
+	standby, err := pulsarConn.newClient("pulsar://standby1:6650")
+	assert.Nil(t, err)
+	pulsarConn.switchClient(primary, standby, 1)
+	assert.Equal(t, standby, switched)
+	assert.Equal(t, 1, pulsarConn.activeIndex)
+	assert.Equal(t, standby, manager.GetConnection())
+	assert.Equal(t, 2, pulsarConn.refs)
+
+	// a switch that lost the race with another one is discarded
+	remove()
+	switched = nil
+	other, err := pulsarConn.newClient("pulsar://standby2:6650")
+	assert.Nil(t, err)
+	pulsarConn.switchClient(primary, other, 2)
+	assert.Nil(t, switched)
+	assert.Equal(t, 1, pulsarConn.activeIndex)
+
+	// references taken on the previous client are still released
+	manager.ReleaseConnection(primary)
+	assert.Equal(t, 1, pulsarConn.refs)
+	manager.ReleaseConnection(standby)
+	assert.Nil(t, pulsarConn.client)
+}
+
+func TestAdminClient(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer admin-token", r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		switch r.URL.Path {
+		case "/admin/v2/tenants":
+			_, _ = w.Write([]byte(`["public","sample"]`))
+		case "/admin/v2/persistent/public/default/partitioned":
+			_, _ = w.Write([]byte(`["persistent://public/default/orders"]`))
+		case "/admin/v2/persistent/public/default":
+			_, _ = w.Write([]byte(`["persistent://public/default/orders-partition-0"]`))
+		case "/admin/v2/persistent/public/default/orders/partitions":
+			_, _ = w.Write([]byte(`{"partitions":4}`))
+		case "/admin/v2/schemas/public/default/orders/schema":
+			_, _ = w.Write([]byte(`{"version":2,"type":"JSON","schema":"{}","properties":{}}`))
+		case "/admin/v2/schemas/public/default/orders/schema/1":
+			_, _ = w.Write([]byte(`{"version":1,"type":"AVRO","schema":"{}","properties":{}}`))
+		case "/admin/v2/persistent/public/default/missing/stats":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"reason":"Topic not found"}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	factory := &Factory{}
+	manager, err := factory.NewManager(map[string]interface{}{
+		"name":     "admin",
+		"url":      "pulsar://localhost:6650",
+		"auth":     "JWT",
+		"jwt":      "admin-token",
+		"adminUrl": server.URL + "/",
+	})
+	assert.Nil(t, err)
+	admin, err := manager.(AdminConnection).AdminClient()
+	assert.Nil(t, err)
+
+	tenants, err := admin.ListTenants()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"public", "sample"}, tenants)
+	partitioned, nonPartitioned, err := admin.ListTopics("public/default")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"persistent://public/default/orders"}, partitioned)
+	assert.Equal(t, []string{"persistent://public/default/orders-partition-0"}, nonPartitioned)
+	partitions, err := admin.GetPartitions("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, partitions)
+	schema, err := admin.GetSchema("persistent://public/default/orders")
+	assert.Nil(t, err)
+	assert.Equal(t, "JSON", schema.Type)
+	schema, err = admin.GetSchemaVersion("orders", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "AVRO", schema.Type)
+
+	requests = nil
+	assert.Nil(t, admin.CreateTopic("public/default/orders", 4))
+	assert.Nil(t, admin.CreateSubscription("non-persistent://public/default/events", "sub 1", "Earliest"))
+	assert.Nil(t, admin.ResetSubscription("public/default/orders", "sub", time.Unix(1600000000, 0)))
+	assert.Nil(t, admin.DeleteTopic("public/default/orders", true, true))
+	assert.Equal(t, []string{
+		"PUT /admin/v2/persistent/public/default/orders/partitions 4",
+		`PUT /admin/v2/non-persistent/public/default/events/subscription/sub%201 {"entryId":-1,"ledgerId":-1}`,
+		"POST /admin/v2/persistent/public/default/orders/subscription/sub/resetcursor/1600000000000 ",
+		"DELETE /admin/v2/persistent/public/default/orders/partitions?force=true ",
+	}, requests)
+
+	_, err = admin.TopicStats("missing", false)
+	adminErr, ok := err.(*AdminError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, adminErr.StatusCode)
+	assert.Equal(t, "Topic not found", adminErr.Reason)
+
+	assert.NotNil(t, admin.CreateNamespace("public"))
+	_, err = admin.ListSubscriptions("public/orders")
+	assert.NotNil(t, err)
+
+	_, err = (&PulsarConnection{settings: &Settings{Name: "noadmin"}}).AdminClient()
+	assert.NotNil(t, err)
+}
+
+type ackConsumer struct {
+	pulsar.Consumer
+	acked  int
+	nacked int
+}
+
+func (c *ackConsumer) Ack(msg pulsar.Message) error {
+	c.acked++
+	return nil
+}
+
+func (c *ackConsumer) Nack(msg pulsar.Message) {
+	c.nacked++
+}
+
+type ackMessage struct {
+	pulsar.Message
+	id pulsar.MessageID
+}
+
+func (m *ackMessage) ID() pulsar.MessageID {
+	return m.id
+}
+
+func TestPendingMessages(t *testing.T) {
+	pending := &PulsarConnection{}
+	first, second := &ackConsumer{}, &ackConsumer{}
+	msg := &ackMessage{id: pulsar.NewMessageID(3, 4, -1, -1)}
+	msgID := pending.AddPendingMessage("first", first, msg, nil)
+	assert.Equal(t, fmt.Sprintf("%x", msg.id.Serialize()), msgID)
+
+	assert.Nil(t, pending.AckMessage(msgID, "", true))
+	assert.Equal(t, 1, first.acked)
+	assert.NotNil(t, pending.AckMessage(msgID, "", true))
+
+	// a settle callback acks or nacks the message instead
+	var settled []bool
+	pending.AddPendingMessage("first", first, msg, func(ack bool) error {
+		settled = append(settled, ack)
+		return nil
+	})
+	assert.Nil(t, pending.AckMessage(msgID, "", false))
+	assert.Equal(t, []bool{false}, settled)
+	assert.Equal(t, 1, first.acked)
+	assert.Equal(t, 0, first.nacked)
+
+	// the same message on two subscriptions needs the subscription
+	pending.AddPendingMessage("first", first, msg, nil)
+	pending.AddPendingMessage("second", second, msg, nil)
+	assert.NotNil(t, pending.AckMessage(msgID, "", true))
+	assert.Nil(t, pending.AckMessage(msgID, "second", false))
+	assert.Equal(t, 1, second.nacked)
+
+	// messages of a closed consumer are dropped
+	pending.RemovePendingMessages(first)
+	assert.NotNil(t, pending.AckMessage(msgID, "first", true))
+	assert.Empty(t, pending.pending)
+}
+
+// orderDescriptorSet is the file setting of testdata/order.proto, the subscriber and publish
+// modules keep a copy in their own testdata
+func orderDescriptorSet(t *testing.T) string {
+	setting, err := ioutil.ReadFile("testdata/order.desc.json")
+	assert.Nil(t, err)
+	return string(setting)
+}
+
+func TestProtoCodec(t *testing.T) {
+	codec, err := NewProtoCodec(orderDescriptorSet(t), "demo.Order")
+	assert.Nil(t, err)
+	payload, err := codec.Encode(map[string]interface{}{"order_id": "o-1", "quantity": 3})
+	assert.Nil(t, err)
+	obj, err := codec.Decode(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"order_id": "o-1", "quantity": float64(3)}, obj)
+
+	_, err = codec.Encode(map[string]interface{}{"orderId": "o-1", "colour": "red"})
+	assert.Contains(t, err.Error(), `object does not match demo.Order`)
+	assert.Contains(t, err.Error(), `unknown field "colour"`)
+	_, err = codec.Encode(map[string]interface{}{"quantity": "three"})
+	assert.NotNil(t, err)
+	_, err = codec.Decode([]byte{0xff})
+	assert.NotNil(t, err)
+
+	_, err = NewProtoCodec(orderDescriptorSet(t), "demo.Missing")
+	assert.NotNil(t, err)
+	_, err = NewProtoCodec("", "demo.Order")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,107 @@
+package connection
+
+import (
+	"strings"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// ClientListener is called with the new client when the connection fails over to another cluster.
+// Producers and consumers created on the previous client must be re-created on the new one, the
+// previous client is closed once every listener has returned.
+type ClientListener func(client pulsar.Client)
+
+// FailoverConnection is implemented by connection managers that can switch between clusters
+type FailoverConnection interface {
+	AddClientListener(listener ClientListener) (remove func())
+}
+
+// AddClientListener registers a listener for cluster switches, the returned func removes it again
+func (p *PulsarConnection) AddClientListener(listener ClientListener) (remove func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.listeners == nil {
+		p.listeners = make(map[int]ClientListener)
+	}
+	id := p.nextListener
+	p.nextListener++
+	p.listeners[id] = listener
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		delete(p.listeners, id)
+	}
+}
+
+// serviceURLs returns the primary url followed by the failover urls in order of preference
+func (p *PulsarConnection) serviceURLs() []string {
+	urls := []string{p.settings.URL}
+	for _, url := range strings.Split(p.settings.FailoverURLs, ";") {
+		url = strings.TrimSpace(url)
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// checkClusters probes the active cluster and fails over to the first reachable service url.
+// A cluster listed ahead of the active one is switched back to as soon as it is reachable again.
+func (p *PulsarConnection) checkClusters() {
+	p.mutex.Lock()
+	client, active := p.client, p.activeIndex
+	p.mutex.Unlock()
+	if client == nil {
+		return
+	}
+	for i, url := range p.serviceURLs() {
+		if i == active {
+			if p.probe(client) == nil {
+				return
+			}
+			continue
+		}
+		candidate, err := p.newClient(url)
+		if err != nil {
+			logger.Warnf("could not create pulsar client for service url %s: %v", url, err)
+			continue
+		}
+		_, err = candidate.TopicPartitions(p.probeTopic())
+		if err != nil {
+			logger.Debugf("service url %s is not reachable: %v", url, err)
+			candidate.Close()
+			continue
+		}
+		p.switchClient(client, candidate, i)
+		return
+	}
+}
+
+// switchClient replaces the active client, notifies the listeners and closes the previous client
+func (p *PulsarConnection) switchClient(previous pulsar.Client, candidate pulsar.Client, index int) {
+	p.mutex.Lock()
+	if p.client != previous {
+		// stopped or switched while probing
+		p.mutex.Unlock()
+		candidate.Close()
+		return
+	}
+	p.client = candidate
+	p.activeIndex = index
+	if p.retired == nil {
+		p.retired = make(map[pulsar.Client]bool)
+	}
+	p.retired[previous] = true
+	listeners := make([]ClientListener, 0, len(p.listeners))
+	for _, listener := range p.listeners {
+		listeners = append(listeners, listener)
+	}
+	p.mutex.Unlock()
+
+	logger.Infof("pulsar connection %s switched to service url %s", p.settings.Name, p.serviceURLs()[index])
+	p.setHealth(nil)
+	for _, listener := range listeners {
+		listener(candidate)
+	}
+	previous.Close()
+}
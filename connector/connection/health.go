@@ -0,0 +1,90 @@
+package connection
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// probe topic used when the connection does not configure one
+const defaultProbeTopic = "persistent://public/default/flogo-healthcheck"
+
+// HealthChecker is implemented by connection managers that can tell whether a broker is reachable
+type HealthChecker interface {
+	HealthCheck() error
+}
+
+// HealthCheck looks up the partition metadata of the probe topic, which needs a round trip to a broker.
+// An error is returned when the client is not started or the lookup fails.
+func (p *PulsarConnection) HealthCheck() error {
+	p.mutex.Lock()
+	client := p.client
+	p.mutex.Unlock()
+	if client == nil {
+		err := fmt.Errorf("pulsar client for connection %s is not started", p.settings.Name)
+		p.setHealth(err)
+		return err
+	}
+	return p.probe(client)
+}
+
+// ServeHTTP reports the health check as a readiness probe, 200 when a broker is reachable and 503 otherwise
+func (p *PulsarConnection) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := p.HealthCheck()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("UP"))
+}
+
+func (p *PulsarConnection) probe(client pulsar.Client) error {
+	_, err := client.TopicPartitions(p.probeTopic())
+	if err != nil {
+		err = fmt.Errorf("pulsar connection %s could not look up probe topic %s: %v", p.settings.Name, p.probeTopic(), err)
+	}
+	p.setHealth(err)
+	return err
+}
+
+func (p *PulsarConnection) probeTopic() string {
+	if p.settings.ProbeTopic != "" {
+		return p.settings.ProbeTopic
+	}
+	return defaultProbeTopic
+}
+
+// setHealth records the result of a probe and logs transitions between healthy and unhealthy
+func (p *PulsarConnection) setHealth(err error) {
+	p.healthMutex.Lock()
+	defer p.healthMutex.Unlock()
+	healthy := err == nil
+	if p.healthKnown && p.healthy == healthy {
+		return
+	}
+	p.healthKnown = true
+	p.healthy = healthy
+	if healthy {
+		logger.Infof("pulsar connection %s is healthy", p.settings.Name)
+	} else {
+		logger.Warnf("pulsar connection %s is unhealthy: %v", p.settings.Name, err)
+	}
+}
+
+// healthLoop checks the clusters every healthCheckInterval seconds until done is closed
+func (p *PulsarConnection) healthLoop(done chan struct{}) {
+	ticker := time.NewTicker(time.Duration(p.settings.HealthCheckInterval) * time.Second)
+	defer ticker.Stop()
+	p.checkClusters()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			p.checkClusters()
+		}
+	}
+}
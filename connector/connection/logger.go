@@ -0,0 +1,102 @@
+package connection
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	pulsarlog "github.com/apache/pulsar-client-go/pulsar/log"
+	"github.com/project-flogo/core/support/log"
+)
+
+// clientLogger bridges the pulsar client logging to a flogo logger, fields are rendered
+// as a sorted key=value prefix.  It implements both pulsarlog.Logger and pulsarlog.Entry.
+type clientLogger struct {
+	logger log.Logger
+	fields pulsarlog.Fields
+	prefix string
+}
+
+func newClientLogger(logger log.Logger) *clientLogger {
+	return &clientLogger{logger: logger}
+}
+
+func (l *clientLogger) withFields(fields pulsarlog.Fields) *clientLogger {
+	merged := make(pulsarlog.Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", k, merged[k])
+	}
+	return &clientLogger{logger: l.logger, fields: merged, prefix: "[" + strings.Join(pairs, " ") + "] "}
+}
+
+// SubLogger implements pulsarlog.Logger
+func (l *clientLogger) SubLogger(fields pulsarlog.Fields) pulsarlog.Logger {
+	return l.withFields(fields)
+}
+
+// WithFields implements pulsarlog.Logger
+func (l *clientLogger) WithFields(fields pulsarlog.Fields) pulsarlog.Entry {
+	return l.withFields(fields)
+}
+
+// WithField implements pulsarlog.Logger
+func (l *clientLogger) WithField(name string, value interface{}) pulsarlog.Entry {
+	return l.withFields(pulsarlog.Fields{name: value})
+}
+
+// WithError implements pulsarlog.Logger
+func (l *clientLogger) WithError(err error) pulsarlog.Entry {
+	return l.withFields(pulsarlog.Fields{"error": err})
+}
+
+// Debug implements pulsarlog.Logger
+func (l *clientLogger) Debug(args ...interface{}) {
+	l.logger.Debug(l.prefix + fmt.Sprint(args...))
+}
+
+// Info implements pulsarlog.Logger
+func (l *clientLogger) Info(args ...interface{}) {
+	l.logger.Info(l.prefix + fmt.Sprint(args...))
+}
+
+// Warn implements pulsarlog.Logger
+func (l *clientLogger) Warn(args ...interface{}) {
+	l.logger.Warn(l.prefix + fmt.Sprint(args...))
+}
+
+// Error implements pulsarlog.Logger
+func (l *clientLogger) Error(args ...interface{}) {
+	l.logger.Error(l.prefix + fmt.Sprint(args...))
+}
+
+// Debugf implements pulsarlog.Logger
+func (l *clientLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(l.prefix + fmt.Sprintf(format, args...))
+}
+
+// Infof implements pulsarlog.Logger
+func (l *clientLogger) Infof(format string, args ...interface{}) {
+	l.logger.Info(l.prefix + fmt.Sprintf(format, args...))
+}
+
+// Warnf implements pulsarlog.Logger
+func (l *clientLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warn(l.prefix + fmt.Sprintf(format, args...))
+}
+
+// Errorf implements pulsarlog.Logger
+func (l *clientLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(l.prefix + fmt.Sprintf(format, args...))
+}
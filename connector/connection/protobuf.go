@@ -0,0 +1,80 @@
+package connection
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtoCodec converts between protobuf payloads and flogo objects for a message type of a
+// descriptor set, as written by protoc --descriptor_set_out --include_imports
+type ProtoCodec struct {
+	descriptor protoreflect.MessageDescriptor
+}
+
+// NewProtoCodec resolves the fully qualified message name in a descriptor set given as a file setting
+func NewProtoCodec(descriptorSet string, messageName string) (*ProtoCodec, error) {
+	content, err := getFileSetting(descriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+	if content == nil {
+		return nil, fmt.Errorf("protobuf needs a descriptor set")
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	err = proto.Unmarshal(content, set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("message %s not found in the descriptor set: %v", messageName, err)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", messageName)
+	}
+	return &ProtoCodec{descriptor: message}, nil
+}
+
+// Decode returns a payload as an object keyed by the field names of the .proto file.  Like the
+// protobuf json mapping 64 bit integers are strings and enums are their names.
+func (c *ProtoCodec) Decode(payload []byte) (map[string]interface{}, error) {
+	message := dynamicpb.NewMessage(c.descriptor)
+	err := proto.Unmarshal(payload, message)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", c.descriptor.FullName(), err)
+	}
+	text, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	err = json.Unmarshal(text, &obj)
+	return obj, err
+}
+
+// Encode returns the payload of an object, fields can use the names of the .proto file or their
+// json names.  Unknown fields and values of the wrong type are an error.
+func (c *ProtoCodec) Encode(obj interface{}) ([]byte, error) {
+	text, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	message := dynamicpb.NewMessage(c.descriptor)
+	err = protojson.Unmarshal(text, message)
+	if err != nil {
+		return nil, fmt.Errorf("object does not match %s: %v", c.descriptor.FullName(), err)
+	}
+	return proto.Marshal(message)
+}
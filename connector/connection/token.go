@@ -0,0 +1,128 @@
+package connection
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokens this close to their exp claim are read again from their source
+const tokenExpiryDelta = 30 * time.Second
+
+// a jwtCommand that does not print the token in time is killed, the client is blocked meanwhile
+const tokenCommandTimeout = 10 * time.Second
+
+// tokenSupplier reads a JWT from a file, an environment variable or the output of a command.
+// The token is cached until it is about to expire, so a token rotated at the source is picked
+// up the next time the client re-authenticates, e.g. when the broker challenges an expired token.
+type tokenSupplier struct {
+	file    string
+	env     string
+	command []string
+	timeout time.Duration
+
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newTokenSupplier(s *Settings) (*tokenSupplier, error) {
+	sources := 0
+	for _, source := range []string{s.JWTFile, s.JWTEnv, s.JWTCommand} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return nil, nil
+	}
+	if sources > 1 || s.JWT != "" {
+		return nil, fmt.Errorf("only one of jwt, jwtFile, jwtEnv or jwtCommand can be set")
+	}
+	return &tokenSupplier{file: s.JWTFile, env: s.JWTEnv, command: strings.Fields(s.JWTCommand), timeout: tokenCommandTimeout}, nil
+}
+
+func (t *tokenSupplier) getToken() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.token != "" && !t.expiry.IsZero() && time.Now().Add(tokenExpiryDelta).Before(t.expiry) {
+		return t.token, nil
+	}
+	token, err := t.readToken()
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", fmt.Errorf("jwt token source %s is empty", t.source())
+	}
+	t.token = token
+	t.expiry = getTokenExpiry(token)
+	if !t.expiry.IsZero() && time.Now().After(t.expiry) {
+		logger.Warnf("jwt token from %s expired at %v", t.source(), t.expiry)
+	}
+	logger.Debugf("jwt token read from %s", t.source())
+	return t.token, nil
+}
+
+func (t *tokenSupplier) readToken() (string, error) {
+	switch {
+	case t.file != "":
+		tokenBytes, err := ioutil.ReadFile(t.file)
+		if err != nil {
+			return "", fmt.Errorf("could not read jwt token file: [%s]", err)
+		}
+		return strings.TrimSpace(string(tokenBytes)), nil
+	case t.env != "":
+		return strings.TrimSpace(os.Getenv(t.env)), nil
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		defer cancel()
+		tokenBytes, err := exec.CommandContext(ctx, t.command[0], t.command[1:]...).Output()
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("jwt token command %s did not finish within %v", t.command[0], t.timeout)
+		}
+		if err != nil {
+			return "", fmt.Errorf("jwt token command %s failed: [%s]", t.command[0], err)
+		}
+		return strings.TrimSpace(string(tokenBytes)), nil
+	}
+}
+
+func (t *tokenSupplier) source() string {
+	switch {
+	case t.file != "":
+		return "file " + t.file
+	case t.env != "":
+		return "environment variable " + t.env
+	default:
+		return "command " + t.command[0]
+	}
+}
+
+// getTokenExpiry returns the exp claim of a JWT, or the zero time when the token has none.
+// The signature is not verified, that is the broker's job.
+func getTokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
@@ -7,5 +7,5 @@ require (
 	github.com/apache/pulsar/pulsar-function-go v0.0.0-20200712212821-c94067d10b03
 	github.com/project-flogo/core v0.10.1
 	github.com/stretchr/testify v1.4.0
-    github.com/linkedin/goavro v2.9.8
+	github.com/linkedin/goavro/v2 v2.9.8
 )
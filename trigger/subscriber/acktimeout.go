@@ -0,0 +1,95 @@
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// the pulsar client does not support ack timeouts, so the trigger tracks them itself
+type trackedMessage struct {
+	consumer pulsar.Consumer
+	deadline time.Time
+}
+
+// errAckTimeout is the failure of a message that was not acked within the ack timeout
+var errAckTimeout = errors.New("not acked within the ack timeout")
+
+// ackTracker fails messages that are neither acked nor nacked within the ack timeout, so a
+// message stuck in a hung flow is redelivered or retried.  The late result of such a flow is ignored.
+type ackTracker struct {
+	timeout time.Duration
+	tick    time.Duration
+
+	mutex    sync.Mutex
+	messages map[pulsar.Message]trackedMessage
+}
+
+func newAckTracker(timeout time.Duration, tick time.Duration) *ackTracker {
+	return &ackTracker{timeout: timeout, tick: tick, messages: make(map[pulsar.Message]trackedMessage)}
+}
+
+func (a *ackTracker) add(consumer pulsar.Consumer, msg pulsar.Message) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.messages[msg] = trackedMessage{consumer: consumer, deadline: time.Now().Add(a.timeout)}
+}
+
+// remove stops tracking a message and reports false when it already timed out
+func (a *ackTracker) remove(msg pulsar.Message) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, ok := a.messages[msg]
+	delete(a.messages, msg)
+	return ok
+}
+
+// removeConsumer stops tracking the messages of a closed consumer
+func (a *ackTracker) removeConsumer(consumer pulsar.Consumer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for msg, tracked := range a.messages {
+		if tracked.consumer == consumer {
+			delete(a.messages, msg)
+		}
+	}
+}
+
+// expired removes and returns the messages whose ack timeout has passed
+func (a *ackTracker) expired(now time.Time) map[pulsar.Message]pulsar.Consumer {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	expired := make(map[pulsar.Message]pulsar.Consumer)
+	for msg, tracked := range a.messages {
+		if now.After(tracked.deadline) {
+			expired[msg] = tracked.consumer
+			delete(a.messages, msg)
+		}
+	}
+	return expired
+}
+
+// trackAcks fails the expired messages every tick until ctx is cancelled
+func (h *Handler) trackAcks(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(h.tracker.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for msg, consumer := range h.tracker.expired(now) {
+				if h.pending != nil && !h.pending.RemovePendingMessage(formatMessageID(msg.ID()), h.consumerOptions.SubscriptionName) {
+					// the ack activity or the flow settled it meanwhile
+					continue
+				}
+				logger.Warnf("message on %s not acked within %v, failing it", h.consumerOptions.SubscriptionName, h.tracker.timeout)
+				_ = h.complete(consumer, msg, errAckTimeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package subscriber
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/linkedin/goavro/v2"
+	pulsarconn "github.com/wcn00/pulsar/connector/connection"
+)
+
+// the partitions of a partitioned topic share the schema of the topic
+var partitionSuffix = regexp.MustCompile(`-partition-\d+$`)
+
+// avroDecoder decodes Avro payloads with the schema of the avroschema setting, or with the schema
+// registered for the topic of the message.  Registered schemas are fetched from the admin api once
+// per topic and schema version.
+type avroDecoder struct {
+	codec *goavro.Codec
+	admin *pulsarconn.AdminClient
+
+	mutex  sync.Mutex
+	codecs map[string]*goavro.Codec
+}
+
+func newAvroDecoder(schema string, connection interface{}) (*avroDecoder, error) {
+	if schema != "" {
+		codec, err := goavro.NewCodec(schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid avroschema: %v", err)
+		}
+		return &avroDecoder{codec: codec}, nil
+	}
+	manager, ok := connection.(pulsarconn.AdminConnection)
+	if !ok {
+		return nil, fmt.Errorf("format Avro needs the avroschema setting or a connection with an adminUrl")
+	}
+	admin, err := manager.AdminClient()
+	if err != nil {
+		return nil, fmt.Errorf("format Avro needs the avroschema setting or a connection with an adminUrl: %v", err)
+	}
+	return &avroDecoder{admin: admin, codecs: make(map[string]*goavro.Codec)}, nil
+}
+
+// decode returns the record of an Avro payload, records are decoded into maps
+func (d *avroDecoder) decode(msg pulsar.Message) (interface{}, error) {
+	codec := d.codec
+	if codec == nil {
+		var err error
+		codec, err = d.registeredCodec(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	record, _, err := codec.NativeFromBinary(msg.Payload())
+	if err != nil {
+		return nil, fmt.Errorf("could not decode Avro payload: %v", err)
+	}
+	return record, nil
+}
+
+// registeredCodec returns the codec for the schema version a message was published with, or for
+// the latest schema when the producer did not set one.  The schema is fetched without holding the
+// lock, so a slow admin api does not hold up messages whose codec is cached.
+func (d *avroDecoder) registeredCodec(msg pulsar.Message) (*goavro.Codec, error) {
+	topic := partitionSuffix.ReplaceAllString(msg.Topic(), "")
+	version := int64(-1)
+	if v := msg.SchemaVersion(); len(v) == 8 {
+		version = int64(binary.BigEndian.Uint64(v))
+	}
+	key := fmt.Sprintf("%s@%d", topic, version)
+	d.mutex.Lock()
+	codec, ok := d.codecs[key]
+	d.mutex.Unlock()
+	if ok {
+		return codec, nil
+	}
+	var schema *pulsarconn.SchemaInfo
+	var err error
+	if version < 0 {
+		schema, err = d.admin.GetSchema(topic)
+	} else {
+		schema, err = d.admin.GetSchemaVersion(topic, version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get the schema of %s: %v", topic, err)
+	}
+	if schema.Type != "AVRO" {
+		return nil, fmt.Errorf("the schema of %s is %s, not AVRO", topic, schema.Type)
+	}
+	codec, err = goavro.NewCodec(schema.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema registered for %s: %v", topic, err)
+	}
+	d.mutex.Lock()
+	d.codecs[key] = codec
+	d.mutex.Unlock()
+	return codec, nil
+}
@@ -0,0 +1,435 @@
+package subscriber
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// consume receives messages until ctx is cancelled or the consumer is closed and hands them to
+// concurrency workers, so at most concurrency messages or batches are handled at a time.  With key
+// ordering every worker has its own lane and messages with the same key always go to the same lane.
+// The messages being handled when ctx is cancelled are still acked or nacked before consume returns.
+func (h *Handler) consume(ctx context.Context, wg *sync.WaitGroup, consumer pulsar.Consumer) {
+	defer wg.Done()
+	lanes := make([]chan []pulsar.Message, h.concurrency)
+	var workers sync.WaitGroup
+	for i := range lanes {
+		if i == 0 || h.keyOrdered {
+			lanes[i] = make(chan []pulsar.Message)
+		} else {
+			lanes[i] = lanes[0]
+		}
+		workers.Add(1)
+		go func(lane chan []pulsar.Message) {
+			defer workers.Done()
+			for msgs := range lane {
+				if h.batchSize > 1 {
+					h.handleBatch(consumer, msgs)
+				} else {
+					h.handleMessage(consumer, msgs[0])
+				}
+			}
+		}(lanes[i])
+	}
+	defer func() {
+		for i, lane := range lanes {
+			if i == 0 || h.keyOrdered {
+				close(lane)
+			}
+		}
+		workers.Wait()
+	}()
+	next := 0
+	for {
+		msgs, err := h.receive(ctx, consumer)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Debugf("receive on %s stopped: %v", h.consumerOptions.SubscriptionName, err)
+			}
+			// received while stopping, let the broker redeliver them
+			h.nackAll(consumer, msgs)
+			return
+		}
+		lane := lanes[0]
+		if h.keyOrdered {
+			lane = lanes[laneIndex(msgs[0], &next, len(lanes))]
+		}
+		select {
+		case lane <- msgs:
+		case <-ctx.Done():
+			h.nackAll(consumer, msgs)
+			return
+		}
+	}
+}
+
+// receive returns the next message, in batch mode it returns up to batchSize messages received
+// within batchTimeout of the first one
+func (h *Handler) receive(ctx context.Context, consumer pulsar.Consumer) ([]pulsar.Message, error) {
+	msg, err := consumer.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []pulsar.Message{msg}
+	if h.batchSize <= 1 {
+		return msgs, nil
+	}
+	batchCtx, cancel := context.WithTimeout(ctx, h.batchTimeout)
+	defer cancel()
+	for len(msgs) < h.batchSize {
+		msg, err = consumer.Receive(batchCtx)
+		if err != nil {
+			if ctx.Err() == nil && batchCtx.Err() == context.DeadlineExceeded {
+				break
+			}
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// laneIndex hashes the ordering key, or the key when there is none, onto a lane.  Messages
+// without a key have no order to keep and are spread round robin.
+func laneIndex(msg pulsar.Message, next *int, lanes int) int {
+	key := msg.OrderingKey()
+	if key == "" {
+		key = msg.Key()
+	}
+	if key == "" {
+		*next = (*next + 1) % lanes
+		return *next
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(lanes))
+}
+
+func (h *Handler) handleMessage(consumer pulsar.Consumer, msg pulsar.Message) {
+	h.track(consumer, msg)
+	out, err := h.newOutput(msg)
+	if err != nil {
+		logger.Errorf("could not decode a message on %s, nacking it: %v", h.consumerOptions.SubscriptionName, err)
+		h.settle(consumer, msg, err)
+		return
+	}
+	// Do something with the message
+	results, err := h.handler.Handle(context.Background(), out)
+	if err != nil {
+		// Failed to process messages
+		h.settle(consumer, msg, err)
+		return
+	}
+	reply := &Reply{}
+	err = reply.FromMap(results)
+	if err != nil {
+		logger.Errorf("invalid reply for a message on %s, nacking it: %v", h.consumerOptions.SubscriptionName, err)
+		h.settle(consumer, msg, err)
+		return
+	}
+	if reply.Ack != nil {
+		h.settle(consumer, msg, replyFailure(*reply.Ack))
+	} else if h.pending == nil {
+		// Message processed successfully
+		h.settle(consumer, msg, nil)
+	}
+}
+
+// handleBatch passes the messages to the flow in one invocation.  All messages are nacked when the
+// flow fails, otherwise the acks reply decides per index and the ack reply for the whole batch.
+// Without a reply all messages are acked, or left to the ack activity in Manual ack mode.
+func (h *Handler) handleBatch(consumer pulsar.Consumer, msgs []pulsar.Message) {
+	out := &Output{Messages: make([]interface{}, 0, len(msgs))}
+	decoded := make([]pulsar.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		h.track(consumer, msg)
+		msgOut, err := h.newOutput(msg)
+		if err != nil {
+			// a message that can not be decoded is nacked on its own, the rest of the batch is handled
+			logger.Errorf("could not decode a message on %s, nacking it: %v", h.consumerOptions.SubscriptionName, err)
+			h.settle(consumer, msg, err)
+			continue
+		}
+		values := msgOut.ToMap()
+		delete(values, "messages")
+		out.Messages = append(out.Messages, values)
+		decoded = append(decoded, msg)
+	}
+	if len(decoded) == 0 {
+		return
+	}
+	msgs = decoded
+	results, err := h.handler.Handle(context.Background(), out)
+	if err != nil {
+		h.settleAll(consumer, msgs, err)
+		return
+	}
+	reply := &Reply{}
+	err = reply.FromMap(results)
+	if err == nil && reply.Acks != nil && len(reply.Acks) != len(msgs) {
+		err = fmt.Errorf("acks reply has %d entries for a batch of %d messages", len(reply.Acks), len(msgs))
+	}
+	if err != nil {
+		logger.Errorf("invalid acks reply for a batch on %s, nacking the batch: %v", h.consumerOptions.SubscriptionName, err)
+		h.settleAll(consumer, msgs, err)
+		return
+	}
+	switch {
+	case reply.Acks != nil:
+		for i, msg := range msgs {
+			h.settle(consumer, msg, replyFailure(reply.Acks[i]))
+		}
+	case reply.Ack != nil:
+		h.settleAll(consumer, msgs, replyFailure(*reply.Ack))
+	case h.pending == nil:
+		h.settleAll(consumer, msgs, nil)
+	}
+}
+
+// errNacked is the failure of a message the flow nacked with its reply
+var errNacked = errors.New("nacked by the flow")
+
+func replyFailure(ack bool) error {
+	if ack {
+		return nil
+	}
+	return errNacked
+}
+
+// track holds a message for the ack activity in Manual ack mode and starts its ack timeout.  The
+// ack activity settles the message like a reply of the flow would.
+func (h *Handler) track(consumer pulsar.Consumer, msg pulsar.Message) {
+	if h.tracker != nil {
+		h.tracker.add(consumer, msg)
+	}
+	if h.pending != nil {
+		h.pending.AddPendingMessage(h.consumerOptions.SubscriptionName, consumer, msg, func(ack bool) error {
+			if h.tracker != nil {
+				h.tracker.remove(msg)
+			}
+			if !ack {
+				return h.complete(consumer, msg, errNacked)
+			}
+			return h.complete(consumer, msg, nil)
+		})
+	}
+}
+
+// settle acks a message, or nacks it when failure is not nil.  In Manual ack mode a message the
+// ack activity already acked is not acked twice, and a message that was redelivered after its ack
+// timeout is not settled again.
+func (h *Handler) settle(consumer pulsar.Consumer, msg pulsar.Message, failure error) {
+	if h.pending != nil {
+		// the ack activity and the ack timeout also remove the message, whoever removes it settles it
+		if !h.pending.RemovePendingMessage(formatMessageID(msg.ID()), h.consumerOptions.SubscriptionName) {
+			logger.Debugf("message on %s already acked by the flow or redelivered after the ack timeout", h.consumerOptions.SubscriptionName)
+			return
+		}
+		if h.tracker != nil {
+			h.tracker.remove(msg)
+		}
+	} else if h.tracker != nil && !h.tracker.remove(msg) {
+		logger.Warnf("ignoring the result for a message on %s that was redelivered after the ack timeout", h.consumerOptions.SubscriptionName)
+		return
+	}
+	err := h.complete(consumer, msg, failure)
+	if err != nil {
+		logger.Warnf("could not ack message on %s: %v", h.consumerOptions.SubscriptionName, err)
+	}
+}
+
+// complete acks a message, or fails it when failure is not nil.  With retries a failed message is
+// sent to the retry topic instead of being nacked, and on its last delivery it is sent to the dead
+// letter topic.
+func (h *Handler) complete(consumer pulsar.Consumer, msg pulsar.Message, failure error) error {
+	if failure != nil {
+		if h.retry != nil {
+			h.reconsumeLater(consumer, msg, failure)
+		} else if h.lastDelivery(msg) {
+			h.deadLetter(consumer, msg, failure)
+		} else {
+			h.nack(consumer, msg)
+		}
+		return nil
+	}
+	if h.cumulative != nil {
+		return h.cumulative.ack(consumer, msg)
+	}
+	return consumer.Ack(msg)
+}
+
+// nack redelivers a message, in Cumulative ack mode it holds back cumulative acks until it is acked
+func (h *Handler) nack(consumer pulsar.Consumer, msg pulsar.Message) {
+	if h.cumulative != nil {
+		h.cumulative.nacked(consumer, msg)
+	}
+	consumer.Nack(msg)
+}
+
+// cumulativeAcks keeps cumulative acks from moving past a nacked message, which would ack it
+// before it is redelivered.  While nacked messages are outstanding messages are acked one by one.
+type cumulativeAcks struct {
+	mutex       sync.Mutex
+	outstanding map[string]pulsar.Consumer
+}
+
+func newCumulativeAcks() *cumulativeAcks {
+	return &cumulativeAcks{outstanding: make(map[string]pulsar.Consumer)}
+}
+
+func (c *cumulativeAcks) nacked(consumer pulsar.Consumer, msg pulsar.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.outstanding[formatMessageID(msg.ID())] = consumer
+}
+
+// settled drops a nacked message that left the subscription without an ack through the
+// cumulative acks, e.g. because it was dead lettered or sent to the retry topic
+func (c *cumulativeAcks) settled(msg pulsar.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.outstanding, formatMessageID(msg.ID()))
+}
+
+// removeConsumer drops the nacked messages of a closed consumer, the broker redelivers every
+// message it did not ack
+func (c *cumulativeAcks) removeConsumer(consumer pulsar.Consumer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, nackedBy := range c.outstanding {
+		if nackedBy == consumer {
+			delete(c.outstanding, id)
+		}
+	}
+}
+
+func (c *cumulativeAcks) held() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.outstanding) > 0
+}
+
+// ack acks a message cumulatively, or only that message while nacked messages are outstanding
+func (c *cumulativeAcks) ack(consumer pulsar.Consumer, msg pulsar.Message) error {
+	c.mutex.Lock()
+	delete(c.outstanding, formatMessageID(msg.ID()))
+	held := len(c.outstanding) > 0
+	c.mutex.Unlock()
+	if held {
+		return consumer.Ack(msg)
+	}
+	return consumer.AckCumulative(msg)
+}
+
+// settleAll settles the messages of a batch, cumulative acks only need the last message
+func (h *Handler) settleAll(consumer pulsar.Consumer, msgs []pulsar.Message, failure error) {
+	if failure == nil && h.cumulative != nil && !h.cumulative.held() {
+		if h.tracker != nil {
+			for _, msg := range msgs[:len(msgs)-1] {
+				h.tracker.remove(msg)
+			}
+		}
+		h.settle(consumer, msgs[len(msgs)-1], nil)
+		return
+	}
+	for _, msg := range msgs {
+		h.settle(consumer, msg, failure)
+	}
+}
+
+func (h *Handler) newOutput(msg pulsar.Message) (*Output, error) {
+	out := &Output{}
+	if h.avro != nil {
+		obj, err := h.avro.decode(msg)
+		if err != nil {
+			return nil, err
+		}
+		out.MessageObj = obj
+	} else if h.proto != nil {
+		obj, err := h.proto.Decode(msg.Payload())
+		if err != nil {
+			return nil, err
+		}
+		out.MessageObj = obj
+	} else if h.json != nil {
+		obj, err := h.json.decode(msg.Payload())
+		if err != nil {
+			if h.json.strict {
+				return nil, err
+			}
+			out.Message = string(msg.Payload())
+			out.ParseError = err.Error()
+		}
+		out.MessageObj = obj
+	} else if h.format == "Bytes" {
+		out.Payload = msg.Payload()
+	} else if h.format == "Base64" {
+		out.Message = base64.StdEncoding.EncodeToString(msg.Payload())
+	} else {
+		out.Message = string(msg.Payload())
+	}
+	out.Key = msg.Key()
+	out.Properties = msg.Properties()
+	setMessageMetadata(out, msg)
+	return out, nil
+}
+
+// setMessageMetadata copies the message id, topic, times and delivery details to the output.
+// Times are milliseconds since the epoch, the event time is 0 when the producer did not set one.
+func setMessageMetadata(out *Output, msg pulsar.Message) {
+	out.Topic = msg.Topic()
+	out.ProducerName = msg.ProducerName()
+	out.OrderingKey = msg.OrderingKey()
+	out.RedeliveryCount = int(msg.RedeliveryCount())
+	out.PublishTime = toMillis(msg.PublishTime())
+	out.EventTime = toMillis(msg.EventTime())
+	id := msg.ID()
+	if id == nil {
+		return
+	}
+	out.MsgID = formatMessageID(id)
+	out.LedgerID = id.LedgerID()
+	out.EntryID = id.EntryID()
+	out.Partition = int(id.PartitionIdx())
+	out.BatchIndex = int(id.BatchIdx())
+}
+
+// formatMessageID hex encodes the serialized message id, like the msgid output of the publish activity
+func formatMessageID(id pulsar.MessageID) string {
+	return fmt.Sprintf("%x", id.Serialize())
+}
+
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (h *Handler) nackAll(consumer pulsar.Consumer, msgs []pulsar.Message) {
+	for _, msg := range msgs {
+		h.nack(consumer, msg)
+	}
+}
+
+// waitTimeout waits for wg and reports false when the timeout expired first
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
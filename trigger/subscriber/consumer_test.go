@@ -0,0 +1,1064 @@
+package subscriber
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/linkedin/goavro/v2"
+	"github.com/project-flogo/core/action"
+	"github.com/project-flogo/core/support/log"
+	"github.com/project-flogo/core/trigger"
+	"github.com/stretchr/testify/assert"
+	pulsarconn "github.com/wcn00/pulsar/connector/connection"
+)
+
+type fakeMessage struct {
+	pulsar.Message
+	key         string
+	orderingKey string
+	payload     []byte
+	properties  map[string]string
+	id          pulsar.MessageID
+	topic       string
+	publishTime time.Time
+	redelivered uint32
+	schema      []byte
+}
+
+func (m *fakeMessage) Key() string                   { return m.key }
+func (m *fakeMessage) OrderingKey() string           { return m.orderingKey }
+func (m *fakeMessage) Payload() []byte               { return m.payload }
+func (m *fakeMessage) Properties() map[string]string { return m.properties }
+func (m *fakeMessage) Topic() string                 { return m.topic }
+func (m *fakeMessage) ProducerName() string          { return "producer-1" }
+func (m *fakeMessage) RedeliveryCount() uint32       { return m.redelivered }
+func (m *fakeMessage) PublishTime() time.Time        { return m.publishTime }
+func (m *fakeMessage) EventTime() time.Time          { return time.Time{} }
+func (m *fakeMessage) SchemaVersion() []byte         { return m.schema }
+func (m *fakeMessage) ID() pulsar.MessageID {
+	if m.id == nil {
+		return pulsar.NewMessageID(1, 1, -1, -1)
+	}
+	return m.id
+}
+
+type fakeConsumer struct {
+	pulsar.Consumer
+	messages chan pulsar.Message
+
+	mutex        sync.Mutex
+	acked        []pulsar.Message
+	nacked       []pulsar.Message
+	cumulative   []pulsar.Message
+	retried      []retriedMessage
+	closed       bool
+	unsubscribed bool
+}
+
+func newFakeConsumer() *fakeConsumer {
+	return &fakeConsumer{messages: make(chan pulsar.Message, 100)}
+}
+
+func (c *fakeConsumer) Receive(ctx context.Context) (pulsar.Message, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case msg := <-c.messages:
+		return msg, nil
+	}
+}
+
+func (c *fakeConsumer) Ack(msg pulsar.Message) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.acked = append(c.acked, msg)
+	return nil
+}
+
+func (c *fakeConsumer) AckCumulative(msg pulsar.Message) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cumulative = append(c.cumulative, msg)
+	return nil
+}
+
+func (c *fakeConsumer) Nack(msg pulsar.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nacked = append(c.nacked, msg)
+}
+
+type retriedMessage struct {
+	msg        pulsar.Message
+	properties map[string]string
+	delay      time.Duration
+}
+
+func (c *fakeConsumer) ReconsumeLaterWithCustomProperties(msg pulsar.Message, properties map[string]string, delay time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.retried = append(c.retried, retriedMessage{msg: msg, properties: properties, delay: delay})
+}
+
+func (c *fakeConsumer) Unsubscribe() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unsubscribed = true
+	return nil
+}
+
+func (c *fakeConsumer) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+}
+
+func (c *fakeConsumer) counts() (acked int, nacked int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.acked), len(c.nacked)
+}
+
+type fakeProducer struct {
+	pulsar.Producer
+	topic string
+
+	mutex  sync.Mutex
+	sent   []*pulsar.ProducerMessage
+	closed bool
+}
+
+func (p *fakeProducer) Send(ctx context.Context, msg *pulsar.ProducerMessage) (pulsar.MessageID, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sent = append(p.sent, msg)
+	return pulsar.NewMessageID(2, int64(len(p.sent)), -1, -1), nil
+}
+
+func (p *fakeProducer) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+}
+
+type fakeClient struct {
+	pulsar.Client
+	consumer  *fakeConsumer
+	options   []pulsar.ConsumerOptions
+	producers []*fakeProducer
+	failures  int
+}
+
+func (c *fakeClient) CreateProducer(options pulsar.ProducerOptions) (pulsar.Producer, error) {
+	producer := &fakeProducer{topic: options.Topic}
+	c.producers = append(c.producers, producer)
+	return producer, nil
+}
+
+func (c *fakeClient) Subscribe(options pulsar.ConsumerOptions) (pulsar.Consumer, error) {
+	if c.failures > 0 {
+		c.failures--
+		return nil, errors.New("broker unavailable")
+	}
+	c.options = append(c.options, options)
+	return c.consumer, nil
+}
+
+type fakeManager struct {
+	pulsarconn.PendingMessages
+	client   *fakeClient
+	admin    *pulsarconn.AdminClient
+	released bool
+}
+
+func (m *fakeManager) AdminClient() (*pulsarconn.AdminClient, error) {
+	if m.admin == nil {
+		return nil, errors.New("no adminUrl")
+	}
+	return m.admin, nil
+}
+
+func (m *fakeManager) Type() string                         { return "pulsar" }
+func (m *fakeManager) GetConnection() interface{}           { return m.client }
+func (m *fakeManager) ReleaseConnection(client interface{}) { m.released = true }
+
+type fakeHandler struct {
+	settings map[string]interface{}
+	handle   func(out *Output) error
+
+	mutex sync.Mutex
+	reply map[string]interface{}
+}
+
+func (h *fakeHandler) setReply(reply map[string]interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.reply = reply
+}
+
+func (h *fakeHandler) Name() string                     { return "fake" }
+func (h *fakeHandler) Settings() map[string]interface{} { return h.settings }
+func (h *fakeHandler) Schemas() *trigger.SchemaConfig   { return nil }
+func (h *fakeHandler) Handle(ctx context.Context, triggerData interface{}) (map[string]interface{}, error) {
+	err := h.handle(triggerData.(*Output))
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.reply, err
+}
+
+type fakeInitContext struct {
+	handlers []trigger.Handler
+}
+
+func (c *fakeInitContext) Logger() log.Logger             { return log.RootLogger() }
+func (c *fakeInitContext) GetHandlers() []trigger.Handler { return c.handlers }
+
+// newFakeTrigger creates and initializes a trigger with one handler on a fake client
+func newFakeTrigger(t *testing.T, settings map[string]interface{}, handlerSettings map[string]interface{}, handle func(out *Output) error) (*Trigger, *fakeManager) {
+	manager := &fakeManager{client: &fakeClient{consumer: newFakeConsumer()}}
+	settings["connection"] = manager
+	handlerSettings["topic"] = "orders"
+	handlerSettings["subscription"] = "orders-sub"
+	trg, err := (&Factory{}).New(&trigger.Config{Settings: settings})
+	assert.Nil(t, err)
+	err = trg.Initialize(&fakeInitContext{handlers: []trigger.Handler{&fakeHandler{settings: handlerSettings, handle: handle}}})
+	assert.Nil(t, err)
+	return trg.(*Trigger), manager
+}
+
+func TestStopIdleConsumer(t *testing.T) {
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"unsubscribeonstop": true}, func(out *Output) error {
+		return nil
+	})
+	consumer := manager.client.consumer
+	assert.Nil(t, trg.Start())
+	consumer.messages <- &fakeMessage{payload: []byte("ok")}
+	assert.Eventually(t, func() bool {
+		acked, _ := consumer.counts()
+		return acked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Stop returns even though Receive is blocked on an empty topic
+	stopped := make(chan struct{})
+	go func() {
+		_ = trg.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	assert.True(t, consumer.closed)
+	assert.True(t, consumer.unsubscribed)
+	assert.True(t, manager.released)
+}
+
+func TestStopDrainsInFlightMessage(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	trg, manager := newFakeTrigger(t, map[string]interface{}{"draintimeout": 5}, map[string]interface{}{}, func(out *Output) error {
+		close(started)
+		<-release
+		return errors.New("failed")
+	})
+	consumer := manager.client.consumer
+	assert.Nil(t, trg.Start())
+	consumer.messages <- &fakeMessage{payload: []byte("slow")}
+	<-started
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	assert.Nil(t, trg.Stop())
+	_, nacked := consumer.counts()
+	assert.Equal(t, 1, nacked)
+	assert.False(t, consumer.unsubscribed)
+	assert.True(t, consumer.closed)
+}
+
+func TestNegativeDrainTimeout(t *testing.T) {
+	_, err := (&Factory{}).New(&trigger.Config{Settings: map[string]interface{}{"connection": &fakeManager{}, "draintimeout": -1}})
+	assert.NotNil(t, err)
+}
+
+func TestConcurrency(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"concurrency": 4}, func(out *Output) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		<-release
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		if out.Message == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	consumer := manager.client.consumer
+	for i := 0; i < 10; i++ {
+		payload := "ok"
+		if i%5 == 0 {
+			payload = "fail"
+		}
+		consumer.messages <- &fakeMessage{payload: []byte(payload)}
+	}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return running == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	assert.Eventually(t, func() bool {
+		acked, nacked := consumer.counts()
+		return acked == 8 && nacked == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	assert.Equal(t, 4, maxRunning)
+}
+
+func TestKeyOrdering(t *testing.T) {
+	var mutex sync.Mutex
+	handled := map[string][]string{}
+	running := map[string]bool{}
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"concurrency": 4, "ordering": "Key"}, func(out *Output) error {
+		mutex.Lock()
+		if running[out.Key] {
+			t.Errorf("messages with key %s handled concurrently", out.Key)
+		}
+		running[out.Key] = true
+		mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		running[out.Key] = false
+		handled[out.Key] = append(handled[out.Key], out.Message)
+		mutex.Unlock()
+		return nil
+	})
+	consumer := manager.client.consumer
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 50; i++ {
+		key := keys[i%len(keys)]
+		consumer.messages <- &fakeMessage{key: key, payload: []byte(fmt.Sprintf("%s-%02d", key, i))}
+	}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, _ := consumer.counts()
+		return acked == 50
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	for _, key := range keys {
+		assert.Len(t, handled[key], 10)
+		assert.True(t, sort.StringsAreSorted(handled[key]), "messages for key %s out of order: %v", key, handled[key])
+	}
+}
+
+func TestLaneIndex(t *testing.T) {
+	next := 0
+	lane := laneIndex(&fakeMessage{key: "order-1"}, &next, 8)
+	assert.Equal(t, lane, laneIndex(&fakeMessage{key: "order-1"}, &next, 8))
+	assert.Equal(t, lane, laneIndex(&fakeMessage{key: "other", orderingKey: "order-1"}, &next, 8))
+	assert.Equal(t, 1, laneIndex(&fakeMessage{}, &next, 8))
+	assert.Equal(t, 2, laneIndex(&fakeMessage{}, &next, 8))
+}
+
+func TestBatch(t *testing.T) {
+	var mutex sync.Mutex
+	var batches [][]interface{}
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"batchsize": 3, "batchtimeout": 50}, func(out *Output) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		batches = append(batches, out.Messages)
+		return nil
+	})
+	trg.handlers[0].handler.(*fakeHandler).setReply(map[string]interface{}{"acks": []interface{}{true, false, true}})
+	consumer := manager.client.consumer
+	var msgs []pulsar.Message
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, &fakeMessage{key: fmt.Sprint(i), payload: []byte("batch"), id: pulsar.NewMessageID(7, int64(i), -1, -1)})
+		consumer.messages <- msgs[i]
+	}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, nacked := consumer.counts()
+		return acked+nacked == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	// a full batch of 3 and a batch of 1 flushed by the timeout, whose reply does not match
+	assert.Len(t, batches, 2)
+	assert.Len(t, batches[0], 3)
+	assert.Len(t, batches[1], 1)
+	first := batches[0][0].(map[string]interface{})
+	assert.Equal(t, "0", first["key"])
+	assert.Equal(t, "batch", first["message"])
+	assert.Equal(t, fmt.Sprintf("%x", pulsar.NewMessageID(7, 0, -1, -1).Serialize()), first["msgid"])
+	assert.Equal(t, []pulsar.Message{msgs[0], msgs[2]}, consumer.acked)
+	assert.Len(t, consumer.nacked, 2)
+}
+
+func TestBatchAllOrNothing(t *testing.T) {
+	fail := true
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"batchsize": 2}, func(out *Output) error {
+		if fail {
+			fail = false
+			return errors.New("failed")
+		}
+		return nil
+	})
+	consumer := manager.client.consumer
+	for i := 0; i < 4; i++ {
+		consumer.messages <- &fakeMessage{payload: []byte("batch")}
+	}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, nacked := consumer.counts()
+		return acked == 2 && nacked == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+}
+
+func TestMessageMetadata(t *testing.T) {
+	var out *Output
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{}, func(o *Output) error {
+		out = o
+		return nil
+	})
+	msg := &fakeMessage{
+		topic:       "persistent://public/default/orders-partition-2",
+		key:         "k",
+		orderingKey: "ok",
+		payload:     []byte("hello"),
+		id:          pulsar.NewMessageID(12, 34, 5, 2),
+		publishTime: time.Unix(1600000000, 123000000),
+	}
+	manager.client.consumer.messages <- msg
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, _ := manager.client.consumer.counts()
+		return acked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	values := out.ToMap()
+	assert.Equal(t, "persistent://public/default/orders-partition-2", values["topic"])
+	assert.Equal(t, fmt.Sprintf("%x", msg.id.Serialize()), values["msgid"])
+	assert.Equal(t, int64(12), values["ledgerId"])
+	assert.Equal(t, int64(34), values["entryId"])
+	assert.Equal(t, 2, values["partition"])
+	assert.Equal(t, 5, values["batchIndex"])
+	assert.Equal(t, int64(1600000000123), values["publishTime"])
+	assert.Equal(t, int64(0), values["eventTime"])
+	assert.Equal(t, "producer-1", values["producerName"])
+	assert.Equal(t, "ok", values["orderingKey"])
+
+	copied := &Output{}
+	assert.Nil(t, copied.FromMap(values))
+	assert.Equal(t, out.MsgID, copied.MsgID)
+	assert.Equal(t, out.LedgerID, copied.LedgerID)
+	assert.Equal(t, out.PublishTime, copied.PublishTime)
+}
+
+func TestTopicSettings(t *testing.T) {
+	options := &pulsar.ConsumerOptions{}
+	assert.Nil(t, setTopics(options, &HandlerSettings{Topics: "orders, invoices,"}))
+	assert.Equal(t, []string{"orders", "invoices"}, options.Topics)
+
+	options = &pulsar.ConsumerOptions{}
+	assert.Nil(t, setTopics(options, &HandlerSettings{TopicsPattern: "persistent://public/default/orders-.*", AutoDiscoveryPeriod: 30}))
+	assert.Equal(t, "persistent://public/default/orders-.*", options.TopicsPattern)
+	assert.Equal(t, 30*time.Second, options.AutoDiscoveryPeriod)
+
+	assert.NotNil(t, setTopics(options, &HandlerSettings{}))
+	assert.NotNil(t, setTopics(options, &HandlerSettings{Topic: "orders", Topics: "invoices"}))
+	assert.NotNil(t, setTopics(options, &HandlerSettings{TopicsPattern: "orders-("}))
+}
+
+func TestManualAck(t *testing.T) {
+	var mutex sync.Mutex
+	var outputs []*Output
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"ackmode": "Manual"}, func(out *Output) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		outputs = append(outputs, out)
+		return nil
+	})
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte("later"), id: pulsar.NewMessageID(1, 1, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(outputs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// nothing is acked until the flow acks the message by its id
+	time.Sleep(50 * time.Millisecond)
+	acked, nacked := consumer.counts()
+	assert.Equal(t, 0, acked+nacked)
+	mutex.Lock()
+	msgID := outputs[0].MsgID
+	mutex.Unlock()
+	assert.Nil(t, manager.AckMessage(msgID, "", true))
+	acked, _ = consumer.counts()
+	assert.Equal(t, 1, acked)
+
+	// a reply decides right away
+	trg.handlers[0].handler.(*fakeHandler).setReply(map[string]interface{}{"ack": false})
+	consumer.messages <- &fakeMessage{payload: []byte("now"), id: pulsar.NewMessageID(1, 2, -1, -1)}
+	assert.Eventually(t, func() bool {
+		_, nacked := consumer.counts()
+		return nacked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// pending messages are dropped when the consumer is closed
+	trg.handlers[0].handler.(*fakeHandler).setReply(nil)
+	consumer.messages <- &fakeMessage{payload: []byte("never"), id: pulsar.NewMessageID(1, 3, -1, -1)}
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(outputs) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	mutex.Lock()
+	assert.NotNil(t, manager.AckMessage(outputs[2].MsgID, "", true))
+	mutex.Unlock()
+}
+
+func TestCumulativeAck(t *testing.T) {
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"ackmode": "Cumulative", "batchsize": 3}, func(out *Output) error {
+		return nil
+	})
+	consumer := manager.client.consumer
+	var msgs []pulsar.Message
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, &fakeMessage{payload: []byte("batch"), id: pulsar.NewMessageID(1, int64(i), -1, -1)})
+		consumer.messages <- msgs[i]
+	}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		consumer.mutex.Lock()
+		defer consumer.mutex.Unlock()
+		return len(consumer.cumulative) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	assert.Equal(t, msgs[2], consumer.cumulative[0])
+	assert.Empty(t, consumer.acked)
+
+	// a nacked message holds back cumulative acks until it is redelivered and acked
+	failed := &fakeMessage{payload: []byte("fail"), id: pulsar.NewMessageID(2, 0, -1, -1)}
+	var deliveries int32
+	trg, manager = newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"ackmode": "Cumulative"}, func(out *Output) error {
+		if out.Message == "fail" && atomic.AddInt32(&deliveries, 1) == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	consumer = manager.client.consumer
+	later := &fakeMessage{payload: []byte("later"), id: pulsar.NewMessageID(2, 1, -1, -1)}
+	last := &fakeMessage{payload: []byte("last"), id: pulsar.NewMessageID(2, 2, -1, -1)}
+	consumer.messages <- failed
+	consumer.messages <- later
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		consumer.mutex.Lock()
+		defer consumer.mutex.Unlock()
+		return len(consumer.acked) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	consumer.messages <- failed
+	consumer.messages <- last
+	assert.Eventually(t, func() bool {
+		consumer.mutex.Lock()
+		defer consumer.mutex.Unlock()
+		return len(consumer.cumulative) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	assert.Equal(t, []pulsar.Message{failed}, consumer.nacked)
+	assert.Equal(t, []pulsar.Message{later}, consumer.acked)
+	assert.Equal(t, []pulsar.Message{failed, last}, consumer.cumulative)
+
+	// a nacked message that is dead lettered on its redelivery releases the cumulative acks
+	trg, manager = newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"ackmode": "Cumulative", "dlqtopic": "orders-dlq", "dlqmaxdeliveries": 2}, func(out *Output) error {
+		if out.Message == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	consumer = manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte("fail"), id: pulsar.NewMessageID(3, 0, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte("fail"), id: pulsar.NewMessageID(3, 0, -1, -1), redelivered: 1}
+	consumer.messages <- &fakeMessage{payload: []byte("good"), id: pulsar.NewMessageID(3, 1, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte("good"), id: pulsar.NewMessageID(3, 2, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		consumer.mutex.Lock()
+		defer consumer.mutex.Unlock()
+		return len(consumer.cumulative) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	acked, nacked := consumer.counts()
+	assert.Equal(t, 1, acked)
+	assert.Equal(t, 1, nacked)
+	assert.Len(t, manager.client.producers[0].sent, 1)
+
+	// the nacked messages of a closed consumer are redelivered from the last cumulative ack
+	handler := trg.handlers[0]
+	handler.cumulative.nacked(consumer, &fakeMessage{id: pulsar.NewMessageID(3, 3, -1, -1)})
+	assert.True(t, handler.cumulative.held())
+	handler.closeConsumer(consumer, false)
+	assert.False(t, handler.cumulative.held())
+}
+
+func TestAckModeSettings(t *testing.T) {
+	for _, handlerSettings := range []map[string]interface{}{
+		{"ackmode": "Cumulative", "subscriptiontype": "Shared"},
+		{"ackmode": "Cumulative", "concurrency": 2},
+		{"ackmode": "Sometimes"},
+	} {
+		handlerSettings["topic"] = "orders"
+		handlerSettings["subscription"] = "orders-sub"
+		trg, err := (&Factory{}).New(&trigger.Config{Settings: map[string]interface{}{"connection": &fakeManager{}}})
+		assert.Nil(t, err)
+		err = trg.Initialize(&fakeInitContext{handlers: []trigger.Handler{&fakeHandler{settings: handlerSettings}}})
+		assert.NotNil(t, err, "%v", handlerSettings)
+	}
+}
+
+func TestManualAckTimeout(t *testing.T) {
+	var manager *fakeManager
+	release := make(chan struct{})
+	late := make(chan error, 1)
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"ackmode": "Manual", "acktimeout": 1000, "acktimeouttick": 50}, func(out *Output) error {
+		if out.Message == "hung" {
+			<-release
+			late <- manager.AckMessage(out.MsgID, "", true)
+			return nil
+		}
+		// acked by the ack activity before the ack timeout
+		return manager.AckMessage(out.MsgID, "", true)
+	})
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte("acked"), id: pulsar.NewMessageID(1, 1, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, _ := consumer.counts()
+		return acked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the timeout is not applied to a message the ack activity settled
+	time.Sleep(1100 * time.Millisecond)
+	_, nacked := consumer.counts()
+	assert.Equal(t, 0, nacked)
+	tracker := trg.handlers[0].tracker
+	tracker.mutex.Lock()
+	assert.Empty(t, tracker.messages)
+	tracker.mutex.Unlock()
+
+	// a message the flow did not ack in time is nacked once, the late ack fails
+	consumer.messages <- &fakeMessage{payload: []byte("hung"), id: pulsar.NewMessageID(1, 2, -1, -1)}
+	assert.Eventually(t, func() bool {
+		_, nacked := consumer.counts()
+		return nacked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	assert.NotNil(t, <-late)
+	assert.Nil(t, trg.Stop())
+	acked, nacked := consumer.counts()
+	assert.Equal(t, 1, acked)
+	assert.Equal(t, 1, nacked)
+}
+
+func TestAckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"acktimeout": 1000, "acktimeouttick": 50}, func(out *Output) error {
+		<-release
+		return nil
+	})
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte("hung")}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		_, nacked := consumer.counts()
+		return nacked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the late result of the hung flow is ignored
+	close(release)
+	assert.Nil(t, trg.Stop())
+	acked, nacked := consumer.counts()
+	assert.Equal(t, 0, acked)
+	assert.Equal(t, 1, nacked)
+}
+
+func TestConsumerTuning(t *testing.T) {
+	options := &pulsar.ConsumerOptions{}
+	s := &HandlerSettings{NackRedeliveryDelay: 500, ReceiverQueueSize: 10, ConsumerName: "ingest-1", AckTimeout: 30000}
+	assert.Nil(t, setConsumerTuning(options, s))
+	assert.Equal(t, 500*time.Millisecond, options.NackRedeliveryDelay)
+	assert.Equal(t, 10, options.ReceiverQueueSize)
+	assert.Equal(t, "ingest-1", options.Name)
+	assert.Equal(t, 1000, s.AckTimeoutTick)
+
+	assert.NotNil(t, setConsumerTuning(options, &HandlerSettings{AckTimeout: 10}))
+	assert.NotNil(t, setConsumerTuning(options, &HandlerSettings{ReceiverQueueSize: -1}))
+	assert.NotNil(t, setConsumerTuning(options, &HandlerSettings{PriorityLevel: 1}))
+}
+
+func TestRetry(t *testing.T) {
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"retryenable": true, "dlqmaxdeliveries": 5, "retrydelay": 100, "retrymaxdelay": 500}, func(out *Output) error {
+		return fmt.Errorf("order %s failed", out.Message)
+	})
+	options := trg.handlers[0].consumerOptions
+	assert.True(t, options.RetryEnable)
+	assert.Equal(t, uint32(5), options.DLQ.MaxDeliveries)
+
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte("first"), id: pulsar.NewMessageID(1, 1, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte("third"), id: pulsar.NewMessageID(1, 2, -1, -1),
+		properties: map[string]string{pulsar.SysPropertyReconsumeTimes: "2"}}
+	consumer.messages <- &fakeMessage{payload: []byte("last"), id: pulsar.NewMessageID(1, 3, -1, -1),
+		properties: map[string]string{pulsar.SysPropertyReconsumeTimes: "4"}}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		consumer.mutex.Lock()
+		defer consumer.mutex.Unlock()
+		return len(consumer.retried) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	// failed messages are retried with a doubling delay instead of being nacked
+	_, nacked := consumer.counts()
+	assert.Equal(t, 0, nacked)
+	assert.Equal(t, 100*time.Millisecond, consumer.retried[0].delay)
+	assert.Equal(t, 400*time.Millisecond, consumer.retried[1].delay)
+	assert.Equal(t, 500*time.Millisecond, consumer.retried[2].delay)
+	assert.Equal(t, "order first failed", consumer.retried[0].properties[errorProperty])
+	assert.Equal(t, "fake", consumer.retried[0].properties[handlerProperty])
+	assert.Equal(t, "5", consumer.retried[2].properties[deliveryCountProperty])
+}
+
+func TestManualRetry(t *testing.T) {
+	var manager *fakeManager
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"ackmode": "Manual", "acktimeout": 1000, "acktimeouttick": 50,
+		"retryenable": true, "dlqmaxdeliveries": 5}, func(out *Output) error {
+		if out.Message == "nacked" {
+			// nacked by the ack activity
+			return manager.AckMessage(out.MsgID, "", false)
+		}
+		return nil
+	})
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte("nacked"), id: pulsar.NewMessageID(1, 1, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte("forgotten"), id: pulsar.NewMessageID(1, 2, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		consumer.mutex.Lock()
+		defer consumer.mutex.Unlock()
+		return len(consumer.retried) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	// neither the nack of the ack activity nor the ack timeout redelivers the message in place
+	acked, nacked := consumer.counts()
+	assert.Equal(t, 0, acked+nacked)
+	assert.Equal(t, errNacked.Error(), consumer.retried[0].properties[errorProperty])
+	assert.Equal(t, errAckTimeout.Error(), consumer.retried[1].properties[errorProperty])
+}
+
+func TestRetrySettings(t *testing.T) {
+	options := &pulsar.ConsumerOptions{}
+	retry, err := setRetry(options, &HandlerSettings{DLQMaxDeliveries: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, retry)
+	assert.False(t, options.RetryEnable)
+
+	s := &HandlerSettings{RetryEnable: true, DLQMaxDeliveries: 3, RetryTopic: "orders-retry"}
+	retry, err = setRetry(options, s)
+	assert.Nil(t, err)
+	assert.Equal(t, "orders-retry", options.DLQ.RetryLetterTopic)
+	assert.Equal(t, time.Second, retry.backoff(0))
+	assert.Equal(t, 8*time.Second, retry.backoff(3))
+	assert.Equal(t, time.Minute, retry.backoff(100))
+
+	for _, s := range []*HandlerSettings{
+		{RetryEnable: true},
+		{RetryEnable: true, DLQMaxDeliveries: 3, TopicsPattern: "orders-.*"},
+		{RetryEnable: true, DLQMaxDeliveries: 3, RetryDelay: 2000, RetryMaxDelay: 1000},
+		{RetryDelay: -1},
+	} {
+		_, err = setRetry(&pulsar.ConsumerOptions{}, s)
+		assert.NotNil(t, err, "%v", s)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"dlqtopic": "orders-dlq", "dlqmaxdeliveries": 3}, func(out *Output) error {
+		return fmt.Errorf("order %s failed", out.Message)
+	})
+	trg.handlers[0].flowName = "ProcessOrder"
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte("first"), id: pulsar.NewMessageID(1, 1, -1, -1), redelivered: 1}
+	consumer.messages <- &fakeMessage{payload: []byte("last"), id: pulsar.NewMessageID(1, 2, -1, -1), redelivered: 2,
+		topic: "orders", properties: map[string]string{"tenant": "acme"}}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, nacked := consumer.counts()
+		return acked == 1 && nacked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	// the last delivery is dead lettered by the trigger with the failure attached
+	producer := manager.client.producers[0]
+	assert.Equal(t, "orders-dlq", producer.topic)
+	assert.True(t, producer.closed)
+	assert.Len(t, producer.sent, 1)
+	properties := producer.sent[0].Properties
+	assert.Equal(t, []byte("last"), producer.sent[0].Payload)
+	assert.Equal(t, "acme", properties["tenant"])
+	assert.Equal(t, "order last failed", properties[errorProperty])
+	assert.Equal(t, "ProcessOrder", properties[flowProperty])
+	assert.Equal(t, "fake", properties[handlerProperty])
+	assert.Equal(t, "3", properties[deliveryCountProperty])
+	assert.Equal(t, "orders", properties[pulsar.SysPropertyRealTopic])
+	_, err := time.Parse(time.RFC3339Nano, properties[failedAtProperty])
+	assert.Nil(t, err)
+}
+
+func TestFlowNames(t *testing.T) {
+	config := &trigger.Config{Handlers: []*trigger.HandlerConfig{
+		{Name: "orders", Actions: []*trigger.ActionConfig{{Config: &action.Config{Settings: map[string]interface{}{"flowURI": "res://flow:process_order"}}}}},
+		{Name: "refunds", Actions: []*trigger.ActionConfig{{Config: &action.Config{Id: "refund_action"}}}},
+		{Name: "empty"},
+	}}
+	assert.Equal(t, map[string]string{"orders": "process_order", "refunds": "refund_action"}, flowNames(config))
+}
+
+const orderSchema = `{"type":"record","name":"Order","fields":[{"name":"id","type":"string"},{"name":"amount","type":"double"}]}`
+
+func TestAvro(t *testing.T) {
+	codec, err := goavro.NewCodec(orderSchema)
+	assert.Nil(t, err)
+	payload, err := codec.BinaryFromNative(nil, map[string]interface{}{"id": "o-1", "amount": 9.5})
+	assert.Nil(t, err)
+
+	var mutex sync.Mutex
+	var outputs []*Output
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"format": "Avro", "avroschema": orderSchema}, func(out *Output) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		outputs = append(outputs, out)
+		return nil
+	})
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: payload, id: pulsar.NewMessageID(1, 1, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte{0xff}, id: pulsar.NewMessageID(1, 2, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, nacked := consumer.counts()
+		return acked == 1 && nacked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	// the payload that is not Avro is nacked without running the flow
+	assert.Len(t, outputs, 1)
+	assert.Equal(t, map[string]interface{}{"id": "o-1", "amount": 9.5}, outputs[0].MessageObj)
+}
+
+func TestAvroRegisteredSchema(t *testing.T) {
+	codec, err := goavro.NewCodec(orderSchema)
+	assert.Nil(t, err)
+	payload, err := codec.BinaryFromNative(nil, map[string]interface{}{"id": "o-2", "amount": 1.0})
+	assert.Nil(t, err)
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		schema, _ := json.Marshal(pulsarconn.SchemaInfo{Version: 3, Type: "AVRO", Schema: orderSchema})
+		_, _ = w.Write(schema)
+	}))
+	defer server.Close()
+
+	decoder, err := newAvroDecoder("", &fakeManager{admin: pulsarconn.NewAdminClient(server.URL, nil)})
+	assert.Nil(t, err)
+	version := []byte{0, 0, 0, 0, 0, 0, 0, 3}
+	for _, topic := range []string{"persistent://public/default/orders-partition-0", "persistent://public/default/orders-partition-1"} {
+		record, err := decoder.decode(&fakeMessage{payload: payload, topic: topic, schema: version})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]interface{}{"id": "o-2", "amount": 1.0}, record)
+	}
+	// the partitions share the schema, which is fetched once
+	assert.Equal(t, []string{"/admin/v2/schemas/public/default/orders/schema/3"}, requests)
+
+	_, err = newAvroDecoder("", &struct{}{})
+	assert.NotNil(t, err)
+	// a connection without an adminUrl fails when the handler is initialized
+	_, err = newAvroDecoder("", &fakeManager{})
+	assert.NotNil(t, err)
+	_, err = newAvroDecoder(`{"type":"record"}`, nil)
+	assert.NotNil(t, err)
+}
+
+// orderDescriptorSet is the file setting of a descriptor set with the message demo.Order, a copy of
+// the connection module's testdata/order.desc.json
+func orderDescriptorSet(t *testing.T) string {
+	setting, err := ioutil.ReadFile("testdata/order.desc.json")
+	assert.Nil(t, err)
+	return string(setting)
+}
+
+func TestProtobuf(t *testing.T) {
+	var mutex sync.Mutex
+	var outputs []*Output
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"format": "Protobuf",
+		"protodescriptor": orderDescriptorSet(t), "protomessage": "demo.Order"}, func(out *Output) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		outputs = append(outputs, out)
+		return nil
+	})
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte{0x0a, 0x03, 'o', '-', '1'}, id: pulsar.NewMessageID(1, 1, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte{0x0a, 0x09}, id: pulsar.NewMessageID(1, 2, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, nacked := consumer.counts()
+		return acked == 1 && nacked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	assert.Len(t, outputs, 1)
+	assert.Equal(t, map[string]interface{}{"order_id": "o-1"}, outputs[0].MessageObj)
+
+	trg2, err := (&Factory{}).New(&trigger.Config{Settings: map[string]interface{}{"connection": &fakeManager{}}})
+	assert.Nil(t, err)
+	err = trg2.Initialize(&fakeInitContext{handlers: []trigger.Handler{&fakeHandler{settings: map[string]interface{}{
+		"topic": "orders", "subscription": "orders-sub", "format": "Protobuf", "protomessage": "demo.Order"}}}})
+	assert.NotNil(t, err)
+}
+
+func TestJSONFormat(t *testing.T) {
+	var mutex sync.Mutex
+	var outputs []*Output
+	handle := func(out *Output) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		outputs = append(outputs, out)
+		return nil
+	}
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"format": "JSON"}, handle)
+	consumer := manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte(`{"id":"o-1","amount":12345678901234567890}`), id: pulsar.NewMessageID(1, 1, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte(`{"id":`), id: pulsar.NewMessageID(1, 2, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, _ := consumer.counts()
+		return acked == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	// valid JSON reaches the flow, invalid JSON is passed raw with the parse error in lenient mode
+	assert.Equal(t, map[string]interface{}{"id": "o-1", "amount": 12345678901234567890.0}, outputs[0].MessageObj)
+	assert.Empty(t, outputs[0].ParseError)
+	assert.Nil(t, outputs[1].MessageObj)
+	assert.Equal(t, `{"id":`, outputs[1].Message)
+	assert.NotEmpty(t, outputs[1].ParseError)
+
+	outputs = nil
+	trg, manager = newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"format": "JSON", "jsonmode": "Strict", "jsonnumbers": "Number"}, handle)
+	consumer = manager.client.consumer
+	consumer.messages <- &fakeMessage{payload: []byte(`{"amount":12345678901234567890}`), id: pulsar.NewMessageID(1, 1, -1, -1)}
+	consumer.messages <- &fakeMessage{payload: []byte(`{} trailing`), id: pulsar.NewMessageID(1, 2, -1, -1)}
+	assert.Nil(t, trg.Start())
+	assert.Eventually(t, func() bool {
+		acked, nacked := consumer.counts()
+		return acked == 1 && nacked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, trg.Stop())
+
+	// strict mode nacks invalid JSON without running the flow
+	assert.Len(t, outputs, 1)
+	assert.Equal(t, map[string]interface{}{"amount": json.Number("12345678901234567890")}, outputs[0].MessageObj)
+}
+
+func TestFormatSettings(t *testing.T) {
+	for _, handlerSettings := range []map[string]interface{}{
+		{"format": "XML"},
+		{"format": "JSON", "jsonmode": "Sloppy"},
+		{"format": "JSON", "jsonnumbers": "Decimal"},
+	} {
+		handlerSettings["topic"] = "orders"
+		handlerSettings["subscription"] = "orders-sub"
+		trg, err := (&Factory{}).New(&trigger.Config{Settings: map[string]interface{}{"connection": &fakeManager{}}})
+		assert.Nil(t, err)
+		err = trg.Initialize(&fakeInitContext{handlers: []trigger.Handler{&fakeHandler{settings: handlerSettings}}})
+		assert.NotNil(t, err, "%v", handlerSettings)
+	}
+}
+
+func TestBytesFormat(t *testing.T) {
+	blob := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe}
+	for format, check := range map[string]func(out *Output){
+		"Bytes": func(out *Output) {
+			assert.Equal(t, blob, out.Payload)
+			assert.Empty(t, out.Message)
+		},
+		"Base64": func(out *Output) {
+			assert.Equal(t, "iVBORwD//g==", out.Message)
+			assert.Nil(t, out.Payload)
+		},
+	} {
+		received := make(chan *Output, 1)
+		trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{"format": format}, func(out *Output) error {
+			received <- out
+			return nil
+		})
+		manager.client.consumer.messages <- &fakeMessage{payload: blob}
+		assert.Nil(t, trg.Start())
+		check(<-received)
+		assert.Nil(t, trg.Stop())
+	}
+}
+
+func TestResubscribeAfterFailover(t *testing.T) {
+	handled := make(chan string, 1)
+	trg, manager := newFakeTrigger(t, map[string]interface{}{}, map[string]interface{}{}, func(out *Output) error {
+		handled <- out.Message
+		return nil
+	})
+	trg.resubscribe = 10 * time.Millisecond
+	assert.Nil(t, trg.Start())
+
+	// the standby cluster refuses the first subscribes, the handler is subscribed once it accepts
+	standby := &fakeClient{consumer: newFakeConsumer(), failures: 2}
+	trg.switchClient(standby)
+	assert.True(t, manager.client.consumer.closed)
+	standby.consumer.messages <- &fakeMessage{payload: []byte("after failover")}
+	select {
+	case msg := <-handled:
+		assert.Equal(t, "after failover", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not re-subscribed")
+	}
+	assert.Nil(t, trg.Stop())
+	assert.Equal(t, 0, standby.failures)
+	assert.True(t, standby.consumer.closed)
+}
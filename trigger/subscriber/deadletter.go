@@ -0,0 +1,134 @@
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/project-flogo/core/trigger"
+)
+
+// properties describing why a message was dead lettered, they are also set on retried messages
+const (
+	errorProperty         = "flogo.error"
+	flowProperty          = "flogo.flow"
+	handlerProperty       = "flogo.handler"
+	failedAtProperty      = "flogo.failedAt"
+	deliveryCountProperty = "flogo.deliveryCount"
+)
+
+// flowNames maps the handler names of a trigger config to the flow their first action runs
+func flowNames(config *trigger.Config) map[string]string {
+	flows := make(map[string]string)
+	for _, handler := range config.Handlers {
+		if len(handler.Actions) == 0 || handler.Actions[0].Config == nil {
+			continue
+		}
+		action := handler.Actions[0].Config
+		if uri, ok := action.Settings["flowURI"].(string); ok {
+			flows[handler.Name] = strings.TrimPrefix(uri, "res://flow:")
+		} else if action.Id != "" {
+			flows[handler.Name] = action.Id
+		}
+	}
+	return flows
+}
+
+// failureProperties describes the failure of a message for whoever triages the dead letter topic
+func (h *Handler) failureProperties(msg pulsar.Message, failure error) map[string]string {
+	attempts, _ := strconv.Atoi(msg.Properties()[pulsar.SysPropertyReconsumeTimes])
+	return map[string]string{
+		errorProperty:         failure.Error(),
+		flowProperty:          h.flowName,
+		handlerProperty:       h.handler.Name(),
+		failedAtProperty:      time.Now().UTC().Format(time.RFC3339Nano),
+		deliveryCountProperty: strconv.Itoa(attempts + int(msg.RedeliveryCount()) + 1),
+	}
+}
+
+var errDeadLetterClosed = errors.New("dead letter producer is closed")
+
+// deadLetterProducer publishes the last failed delivery of a message to the dead letter topic.
+// The dead letter router of the pulsar client only sees redelivered messages and can not tell
+// why they failed, so the trigger dead letters the message itself on its last delivery.
+type deadLetterProducer struct {
+	mutex    sync.Mutex
+	producer pulsar.Producer
+}
+
+// open creates the producer on a client, replacing the producer on the previous client
+func (d *deadLetterProducer) open(client pulsar.Client, topic string) error {
+	producer, err := client.CreateProducer(pulsar.ProducerOptions{Topic: topic})
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	previous := d.producer
+	d.producer = producer
+	d.mutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+func (d *deadLetterProducer) close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.producer != nil {
+		d.producer.Close()
+		d.producer = nil
+	}
+}
+
+// lastDelivery tells if the client would dead letter a message that is nacked now
+func (h *Handler) lastDelivery(msg pulsar.Message) bool {
+	return h.deadLetters != nil && msg.RedeliveryCount()+1 >= h.consumerOptions.DLQ.MaxDeliveries
+}
+
+// deadLetter publishes a failed message with the failure in its properties and acks it, it is
+// nacked instead when the dead letter topic can not be written
+func (h *Handler) deadLetter(consumer pulsar.Consumer, msg pulsar.Message, failure error) {
+	properties := make(map[string]string)
+	for name, value := range msg.Properties() {
+		properties[name] = value
+	}
+	for name, value := range h.failureProperties(msg, failure) {
+		properties[name] = value
+	}
+	properties[pulsar.PropertyOriginMessageID] = msg.ID().String()
+	properties[pulsar.SysPropertyRealTopic] = msg.Topic()
+
+	h.deadLetters.mutex.Lock()
+	producer := h.deadLetters.producer
+	h.deadLetters.mutex.Unlock()
+	var err error
+	if producer == nil {
+		err = errDeadLetterClosed
+	} else {
+		_, err = producer.Send(context.Background(), &pulsar.ProducerMessage{
+			Payload:     msg.Payload(),
+			Key:         msg.Key(),
+			OrderingKey: msg.OrderingKey(),
+			Properties:  properties,
+			EventTime:   msg.EventTime(),
+		})
+	}
+	if err != nil {
+		logger.Errorf("could not dead letter message on %s, nacking it: %v", h.consumerOptions.SubscriptionName, err)
+		h.nack(consumer, msg)
+		return
+	}
+	logger.Warnf("dead lettered message on %s to %s: %v", h.consumerOptions.SubscriptionName, h.consumerOptions.DLQ.DeadLetterTopic, failure)
+	if h.cumulative != nil {
+		h.cumulative.settled(msg)
+	}
+	err = consumer.Ack(msg)
+	if err != nil {
+		logger.Warnf("could not ack dead lettered message on %s: %v", h.consumerOptions.SubscriptionName, err)
+	}
+}
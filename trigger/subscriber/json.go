@@ -0,0 +1,32 @@
+package subscriber
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// jsonDecoder decodes JSON payloads.  In strict mode a payload that is not JSON fails the message,
+// otherwise the flow gets the raw payload in message and the error in parseError.
+type jsonDecoder struct {
+	strict    bool
+	useNumber bool
+}
+
+// decode returns the value of a JSON payload, numbers are float64 or json.Number with useNumber
+func (d *jsonDecoder) decode(payload []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if d.useNumber {
+		decoder.UseNumber()
+	}
+	var obj interface{}
+	err := decoder.Decode(&obj)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = fmt.Errorf("unexpected data after the JSON value")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %v", err)
+	}
+	return obj, nil
+}
@@ -7,17 +7,43 @@ import (
 
 //Settings from Metadata interface
 type Settings struct {
-	Connection connection.Manager `md:"connection,required"`
+	Connection   connection.Manager `md:"connection,required"`
+	DrainTimeout int                `md:"draintimeout"`
 }
 
 //HandlerSettings for this trigger
 type HandlerSettings struct {
-	Topic            string `md:"topic,required"`
-	Subscription     string `md:"subscription,required"`
-	SubscriptionType string `md:"subscriptiontype"`
-	InitialPosition  string `md:"initialposition"`
-	DLQMaxDeliveries int    `md:"dlqmaxdeliveries"`
-	DLQTopic         string `md:"dlqtopic"`
+	Topic               string `md:"topic"`
+	Topics              string `md:"topics"`
+	TopicsPattern       string `md:"topicspattern"`
+	AutoDiscoveryPeriod int    `md:"autodiscoveryperiod"`
+	Subscription        string `md:"subscription,required"`
+	SubscriptionType    string `md:"subscriptiontype"`
+	InitialPosition     string `md:"initialposition"`
+	DLQMaxDeliveries    int    `md:"dlqmaxdeliveries"`
+	DLQTopic            string `md:"dlqtopic"`
+	RetryEnable         bool   `md:"retryenable"`
+	RetryTopic          string `md:"retrytopic"`
+	RetryDelay          int    `md:"retrydelay"`
+	RetryMaxDelay       int    `md:"retrymaxdelay"`
+	UnsubscribeOnStop   bool   `md:"unsubscribeonstop"`
+	Concurrency         int    `md:"concurrency"`
+	Ordering            string `md:"ordering"`
+	BatchSize           int    `md:"batchsize"`
+	BatchTimeout        int    `md:"batchtimeout"`
+	AckMode             string `md:"ackmode"`
+	NackRedeliveryDelay int    `md:"nackredeliverydelay"`
+	AckTimeout          int    `md:"acktimeout"`
+	AckTimeoutTick      int    `md:"acktimeouttick"`
+	ReceiverQueueSize   int    `md:"receiverqueuesize"`
+	ConsumerName        string `md:"consumername"`
+	PriorityLevel       int    `md:"prioritylevel"`
+	Format              string `md:"format"`
+	JSONMode            string `md:"jsonmode"`
+	JSONNumbers         string `md:"jsonnumbers"`
+	AvroSchema          string `md:"avroschema"`
+	ProtoDescriptor     string `md:"protodescriptor"`
+	ProtoMessage        string `md:"protomessage"`
 }
 
 //Output for this trigger
@@ -26,6 +52,21 @@ type Output struct {
 	Properties map[string]string `md:"properties"`
 	Message    string            `md:"message"`
 	MessageObj interface{}       `md:"messageObj"`
+	Payload    []byte            `md:"payload"`
+	Messages   []interface{}     `md:"messages"`
+
+	Topic           string `md:"topic"`
+	MsgID           string `md:"msgid"`
+	LedgerID        int64  `md:"ledgerId"`
+	EntryID         int64  `md:"entryId"`
+	Partition       int    `md:"partition"`
+	BatchIndex      int    `md:"batchIndex"`
+	PublishTime     int64  `md:"publishTime"`
+	EventTime       int64  `md:"eventTime"`
+	RedeliveryCount int    `md:"redeliveryCount"`
+	ProducerName    string `md:"producerName"`
+	OrderingKey     string `md:"orderingKey"`
+	ParseError      string `md:"parseError"`
 }
 
 //FromMap from Metadata interface
@@ -39,6 +80,10 @@ func (o *Output) FromMap(values map[string]interface{}) error {
 	if err != nil {
 		return err
 	}
+	o.Payload, err = coerce.ToBytes(values["payload"])
+	if err != nil {
+		return err
+	}
 	o.Key, err = coerce.ToString(values["key"])
 	if err != nil {
 		return err
@@ -47,6 +92,58 @@ func (o *Output) FromMap(values map[string]interface{}) error {
 	if err != nil {
 		return err
 	}
+	o.Messages, err = coerce.ToArray(values["messages"])
+	if err != nil {
+		return err
+	}
+	o.Topic, err = coerce.ToString(values["topic"])
+	if err != nil {
+		return err
+	}
+	o.MsgID, err = coerce.ToString(values["msgid"])
+	if err != nil {
+		return err
+	}
+	o.LedgerID, err = coerce.ToInt64(values["ledgerId"])
+	if err != nil {
+		return err
+	}
+	o.EntryID, err = coerce.ToInt64(values["entryId"])
+	if err != nil {
+		return err
+	}
+	o.Partition, err = coerce.ToInt(values["partition"])
+	if err != nil {
+		return err
+	}
+	o.BatchIndex, err = coerce.ToInt(values["batchIndex"])
+	if err != nil {
+		return err
+	}
+	o.PublishTime, err = coerce.ToInt64(values["publishTime"])
+	if err != nil {
+		return err
+	}
+	o.EventTime, err = coerce.ToInt64(values["eventTime"])
+	if err != nil {
+		return err
+	}
+	o.RedeliveryCount, err = coerce.ToInt(values["redeliveryCount"])
+	if err != nil {
+		return err
+	}
+	o.ProducerName, err = coerce.ToString(values["producerName"])
+	if err != nil {
+		return err
+	}
+	o.OrderingKey, err = coerce.ToString(values["orderingKey"])
+	if err != nil {
+		return err
+	}
+	o.ParseError, err = coerce.ToString(values["parseError"])
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -56,7 +153,72 @@ func (o *Output) ToMap() map[string]interface{} {
 	return map[string]interface{}{
 		"message":    o.Message,
 		"messageObj": o.MessageObj,
+		"payload":    o.Payload,
 		"key":        o.Key,
 		"properties": o.Properties,
+		"messages":   o.Messages,
+
+		"topic":           o.Topic,
+		"msgid":           o.MsgID,
+		"ledgerId":        o.LedgerID,
+		"entryId":         o.EntryID,
+		"partition":       o.Partition,
+		"batchIndex":      o.BatchIndex,
+		"publishTime":     o.PublishTime,
+		"eventTime":       o.EventTime,
+		"redeliveryCount": o.RedeliveryCount,
+		"producerName":    o.ProducerName,
+		"orderingKey":     o.OrderingKey,
+		"parseError":      o.ParseError,
+	}
+}
+
+//Reply from the handler
+type Reply struct {
+	Ack  *bool  `md:"ack"`
+	Acks []bool `md:"acks"`
+}
+
+//FromMap from Metadata interface
+func (r *Reply) FromMap(values map[string]interface{}) error {
+	r.Ack = nil
+	r.Acks = nil
+	if values["ack"] != nil {
+		ack, err := coerce.ToBool(values["ack"])
+		if err != nil {
+			return err
+		}
+		r.Ack = &ack
+	}
+	if values["acks"] == nil {
+		return nil
+	}
+	acks, err := coerce.ToArray(values["acks"])
+	if err != nil {
+		return err
+	}
+	r.Acks = make([]bool, len(acks))
+	for i, ack := range acks {
+		r.Acks[i], err = coerce.ToBool(ack)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ToMap from Metadata interface
+func (r *Reply) ToMap() map[string]interface{} {
+	var ack interface{}
+	if r.Ack != nil {
+		ack = *r.Ack
+	}
+	acks := make([]interface{}, len(r.Acks))
+	for i, ack := range r.Acks {
+		acks[i] = ack
+	}
+	return map[string]interface{}{
+		"ack":  ack,
+		"acks": acks,
 	}
 }
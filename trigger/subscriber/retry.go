@@ -0,0 +1,83 @@
+package subscriber
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// retry delays in milliseconds used when a handler enables retries without them
+const (
+	defaultRetryDelay    = 1000
+	defaultRetryMaxDelay = 60000
+)
+
+// retryPolicy republishes failed messages to the retry letter topic with an exponential backoff.
+// The pulsar client counts the attempts in the RECONSUMETIMES property and sends the message to
+// the dead letter topic once dlqmaxdeliveries attempts have failed.
+type retryPolicy struct {
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// setRetry validates the retry settings of a handler and enables the retry letter topic.  The
+// client defaults the retry and dead letter topics to <topic>-<subscription>-RETRY and -DLQ.
+func setRetry(consumerOptions *pulsar.ConsumerOptions, s *HandlerSettings) (*retryPolicy, error) {
+	if s.RetryDelay < 0 || s.RetryMaxDelay < 0 || s.DLQMaxDeliveries < 0 {
+		return nil, fmt.Errorf("retrydelay, retrymaxdelay and dlqmaxdeliveries can not be negative")
+	}
+	if !s.RetryEnable {
+		return nil, nil
+	}
+	if s.DLQMaxDeliveries == 0 {
+		return nil, fmt.Errorf("retryenable needs dlqmaxdeliveries, the number of attempts before a message is dead lettered")
+	}
+	if s.TopicsPattern != "" {
+		return nil, fmt.Errorf("retryenable can not be combined with topicspattern")
+	}
+	if s.RetryDelay == 0 {
+		s.RetryDelay = defaultRetryDelay
+	}
+	if s.RetryMaxDelay == 0 {
+		s.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	if s.RetryMaxDelay < s.RetryDelay {
+		return nil, fmt.Errorf("retrymaxdelay can not be shorter than retrydelay")
+	}
+	consumerOptions.RetryEnable = true
+	consumerOptions.DLQ = &pulsar.DLQPolicy{
+		MaxDeliveries:    uint32(s.DLQMaxDeliveries),
+		DeadLetterTopic:  s.DLQTopic,
+		RetryLetterTopic: s.RetryTopic,
+	}
+	return &retryPolicy{
+		delay:    time.Duration(s.RetryDelay) * time.Millisecond,
+		maxDelay: time.Duration(s.RetryMaxDelay) * time.Millisecond,
+	}, nil
+}
+
+// backoff doubles the retry delay for every earlier attempt, up to the max delay
+func (r *retryPolicy) backoff(attempts int) time.Duration {
+	delay := r.delay
+	for i := 0; i < attempts && delay < r.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+	return delay
+}
+
+// reconsumeLater sends a failed message to the retry letter topic, or to the dead letter topic
+// after the last attempt, with the failure in its properties
+func (h *Handler) reconsumeLater(consumer pulsar.Consumer, msg pulsar.Message, failure error) {
+	attempts, _ := strconv.Atoi(msg.Properties()[pulsar.SysPropertyReconsumeTimes])
+	delay := h.retry.backoff(attempts)
+	logger.Debugf("retrying message on %s in %v after %d attempts: %v", h.consumerOptions.SubscriptionName, delay, attempts, failure)
+	if h.cumulative != nil {
+		h.cumulative.settled(msg)
+	}
+	consumer.ReconsumeLaterWithCustomProperties(msg, h.failureProperties(msg, failure), delay)
+}
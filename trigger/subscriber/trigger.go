@@ -2,32 +2,79 @@ package subscriber
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/project-flogo/core/data/coerce"
 	"github.com/project-flogo/core/data/metadata"
+	"github.com/project-flogo/core/support/connection"
 	"github.com/project-flogo/core/support/log"
 	"github.com/project-flogo/core/trigger"
+	pulsarconn "github.com/wcn00/pulsar/connector/connection"
 )
 
-var triggerMd = trigger.NewMetadata(&Settings{}, &HandlerSettings{}, &Output{})
+var triggerMd = trigger.NewMetadata(&Settings{}, &HandlerSettings{}, &Output{}, &Reply{})
 
 func init() {
 	_ = trigger.Register(&Trigger{}, &Factory{})
 }
 
+// drain timeout used when the trigger does not configure one
+const defaultDrainTimeout = 10
+
+// batch timeout in milliseconds used when a handler sets a batch size without one
+const defaultBatchTimeout = 1000
+
+// ack timeouts are checked every second unless the handler sets another tick in milliseconds
+const defaultAckTimeoutTick = 1000
+
+// shortest ack timeout in milliseconds, like the java client
+const minAckTimeout = 1000
+
+// interval between attempts to re-subscribe a handler that could not be subscribed after a failover
+const defaultResubscribeInterval = 5 * time.Second
+
 //Trigger interface type
 type Trigger struct {
-	client   pulsar.Client
-	handlers []*Handler
+	mutex          sync.Mutex
+	connection     connection.Manager
+	client         pulsar.Client
+	handlers       []*Handler
+	removeListener func()
+	flows          map[string]string
+	resubscribe    time.Duration
+	drainTimeout   time.Duration
+	cancel         context.CancelFunc
+	ctx            context.Context
+	wg             sync.WaitGroup
 }
 
 //Handler interface type
 type Handler struct {
-	handler  trigger.Handler
-	consumer pulsar.Consumer
-	running  bool
+	handler           trigger.Handler
+	consumerOptions   pulsar.ConsumerOptions
+	consumer          pulsar.Consumer
+	unsubscribeOnStop bool
+	concurrency       int
+	keyOrdered        bool
+	batchSize         int
+	batchTimeout      time.Duration
+	ackMode           string
+	pending           pulsarconn.ManualAckConnection
+	tracker           *ackTracker
+	cumulative        *cumulativeAcks
+	retry             *retryPolicy
+	deadLetters       *deadLetterProducer
+	flowName          string
+	format            string
+	json              *jsonDecoder
+	avro              *avroDecoder
+	proto             *pulsarconn.ProtoCodec
+	resubscribing     bool
 }
 
 //Factory interface type
@@ -47,7 +94,14 @@ func (*Factory) New(config *trigger.Config) (trigger.Trigger, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Trigger{client: pulsarConn.GetConnection().(pulsar.Client)}, nil
+	if s.DrainTimeout < 0 {
+		return nil, fmt.Errorf("draintimeout can not be negative")
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = defaultDrainTimeout
+	}
+	return &Trigger{connection: pulsarConn, drainTimeout: time.Duration(s.DrainTimeout) * time.Second, flows: flowNames(config),
+		resubscribe: defaultResubscribeInterval}, nil
 }
 
 //Metadata interface implementation to get the metadata
@@ -74,6 +128,10 @@ func (t *Trigger) Initialize(ctx trigger.InitContext) error {
 			Topic:            s.Topic,
 			SubscriptionName: s.Subscription,
 		}
+		err = setTopics(&consumeroptions, s)
+		if err != nil {
+			return err
+		}
 		switch s.SubscriptionType {
 		case "Exclusive":
 			consumeroptions.Type = pulsar.Exclusive
@@ -86,8 +144,8 @@ func (t *Trigger) Initialize(ctx trigger.InitContext) error {
 		}
 		if s.DLQTopic != "" {
 			policy := pulsar.DLQPolicy{
-				MaxDeliveries: uint32(s.DLQMaxDeliveries),
-				Topic:         s.DLQTopic,
+				MaxDeliveries:   uint32(s.DLQMaxDeliveries),
+				DeadLetterTopic: s.DLQTopic,
 			}
 			consumeroptions.DLQ = &policy
 		}
@@ -96,64 +154,308 @@ func (t *Trigger) Initialize(ctx trigger.InitContext) error {
 		} else {
 			consumeroptions.SubscriptionInitialPosition = pulsar.SubscriptionPositionEarliest
 		}
-		consumer, err := t.client.Subscribe(consumeroptions)
+		if s.Concurrency < 0 {
+			return fmt.Errorf("concurrency can not be negative")
+		}
+		if s.Concurrency == 0 {
+			s.Concurrency = 1
+		}
+		if s.Ordering != "" && s.Ordering != "None" && s.Ordering != "Key" {
+			return fmt.Errorf("ordering must be None or Key")
+		}
+		if s.BatchSize < 0 || s.BatchTimeout < 0 {
+			return fmt.Errorf("batchsize and batchtimeout can not be negative")
+		}
+		if s.BatchSize > 1 && s.Ordering == "Key" {
+			return fmt.Errorf("batchsize can not be combined with Key ordering")
+		}
+		if s.BatchTimeout == 0 {
+			s.BatchTimeout = defaultBatchTimeout
+		}
+		h := &Handler{handler: handler, consumerOptions: consumeroptions, unsubscribeOnStop: s.UnsubscribeOnStop,
+			concurrency: s.Concurrency, keyOrdered: s.Ordering == "Key",
+			batchSize: s.BatchSize, batchTimeout: time.Duration(s.BatchTimeout) * time.Millisecond, ackMode: s.AckMode}
+		switch s.AckMode {
+		case "", "Auto":
+		case "Manual":
+			pending, ok := t.connection.(pulsarconn.ManualAckConnection)
+			if !ok {
+				return fmt.Errorf("Manual ack mode is not supported by the connection")
+			}
+			h.pending = pending
+		case "Cumulative":
+			if s.Concurrency > 1 || s.SubscriptionType == "Shared" || s.SubscriptionType == "KeyShared" {
+				return fmt.Errorf("Cumulative ack mode needs concurrency 1 and an Exclusive or Failover subscription")
+			}
+			h.cumulative = newCumulativeAcks()
+		default:
+			return fmt.Errorf("ackmode must be Auto, Manual or Cumulative")
+		}
+		err = setConsumerTuning(&h.consumerOptions, s)
+		if err != nil {
+			return err
+		}
+		h.retry, err = setRetry(&h.consumerOptions, s)
+		if err != nil {
+			return err
+		}
+		if h.retry == nil && h.consumerOptions.DLQ != nil {
+			h.deadLetters = &deadLetterProducer{}
+		}
+		h.flowName = t.flows[handler.Name()]
+		err = t.setFormat(h, s)
 		if err != nil {
 			return err
 		}
-		t.handlers = append(t.handlers, &Handler{handler: handler, consumer: consumer, running: false})
+		if s.AckTimeout > 0 {
+			h.tracker = newAckTracker(time.Duration(s.AckTimeout)*time.Millisecond, time.Duration(s.AckTimeoutTick)*time.Millisecond)
+		}
+		t.handlers = append(t.handlers, h)
 	}
 	return nil
 }
 
-// Start implements util.Managed.Start
-func (t *Trigger) Start() error {
-	for _, handler := range t.handlers {
-		handler.running = true
-		go consume(handler)
+// setFormat validates the payload format of a handler and prepares its decoder
+func (t *Trigger) setFormat(h *Handler, s *HandlerSettings) error {
+	var err error
+	switch s.Format {
+	case "", "String", "Bytes", "Base64":
+		h.format = s.Format
+	case "JSON":
+		if s.JSONMode != "" && s.JSONMode != "Strict" && s.JSONMode != "Lenient" {
+			return fmt.Errorf("jsonmode must be Strict or Lenient")
+		}
+		if s.JSONNumbers != "" && s.JSONNumbers != "Float" && s.JSONNumbers != "Number" {
+			return fmt.Errorf("jsonnumbers must be Float or Number")
+		}
+		h.json = &jsonDecoder{strict: s.JSONMode == "Strict", useNumber: s.JSONNumbers == "Number"}
+	case "Avro":
+		h.avro, err = newAvroDecoder(s.AvroSchema, t.connection)
+	case "Protobuf":
+		h.proto, err = pulsarconn.NewProtoCodec(s.ProtoDescriptor, s.ProtoMessage)
+	default:
+		return fmt.Errorf("format must be String, Bytes, Base64, JSON, Avro or Protobuf")
+	}
+	return err
+}
+
+// setTopics subscribes to a single topic, a comma separated list of topics or every topic matching
+// a regex.  New partitions and topics matching the pattern are discovered every autodiscoveryperiod seconds.
+func setTopics(consumerOptions *pulsar.ConsumerOptions, s *HandlerSettings) error {
+	var topics []string
+	for _, topic := range strings.Split(s.Topics, ",") {
+		topic = strings.TrimSpace(topic)
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	sources := 0
+	for _, set := range []bool{s.Topic != "", len(topics) > 0, s.TopicsPattern != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("handler %s needs exactly one of topic, topics or topicspattern", s.Subscription)
+	}
+	if s.AutoDiscoveryPeriod < 0 {
+		return fmt.Errorf("autodiscoveryperiod can not be negative")
 	}
+	if s.TopicsPattern != "" {
+		_, err := regexp.Compile(s.TopicsPattern)
+		if err != nil {
+			return fmt.Errorf("invalid topicspattern %s: %v", s.TopicsPattern, err)
+		}
+		consumerOptions.TopicsPattern = s.TopicsPattern
+	}
+	consumerOptions.Topics = topics
+	consumerOptions.AutoDiscoveryPeriod = time.Duration(s.AutoDiscoveryPeriod) * time.Second
 	return nil
 }
 
-// Stop implements util.Managed.Stop
-func (t *Trigger) Stop() error {
-	for _, handler := range t.handlers {
-		handler.running = false
+// setConsumerTuning validates and applies the redelivery and flow control settings of a handler
+func setConsumerTuning(consumerOptions *pulsar.ConsumerOptions, s *HandlerSettings) error {
+	if s.NackRedeliveryDelay < 0 || s.AckTimeout < 0 || s.AckTimeoutTick < 0 || s.ReceiverQueueSize < 0 || s.PriorityLevel < 0 {
+		return fmt.Errorf("nackredeliverydelay, acktimeout, acktimeouttick, receiverqueuesize and prioritylevel can not be negative")
+	}
+	if s.PriorityLevel > 0 {
+		return fmt.Errorf("prioritylevel is not supported by the pulsar go client")
+	}
+	if s.AckTimeout > 0 && s.AckTimeout < minAckTimeout {
+		return fmt.Errorf("acktimeout must be at least %d milliseconds", minAckTimeout)
 	}
+	if s.AckTimeoutTick == 0 {
+		s.AckTimeoutTick = defaultAckTimeoutTick
+	}
+	consumerOptions.NackRedeliveryDelay = time.Duration(s.NackRedeliveryDelay) * time.Millisecond
+	consumerOptions.ReceiverQueueSize = s.ReceiverQueueSize
+	consumerOptions.Name = s.ConsumerName
 	return nil
 }
 
-func consume(handler *Handler) {
-	for {
-		var err error
-		msg, err := handler.consumer.Receive(context.Background())
+// Start implements util.Managed.Start, it takes a reference on the connection and subscribes the handlers
+func (t *Trigger) Start() error {
+	client, ok := t.connection.GetConnection().(pulsar.Client)
+	if !ok {
+		return fmt.Errorf("pulsar connection is not available")
+	}
+	t.mutex.Lock()
+	t.client = client
+	for _, handler := range t.handlers {
+		consumer, err := t.client.Subscribe(handler.consumerOptions)
 		if err != nil {
-			logger.Debugf("Error while recieveing message")
-			return
+			t.mutex.Unlock()
+			_ = t.Stop()
+			return err
 		}
-		out := &Output{}
-		if handler.handler.Settings()["format"] != nil &&
-			handler.handler.Settings()["format"].(string) == "JSON" {
-			var obj interface{}
-			err = json.Unmarshal(msg.Payload(), &obj)
+		handler.consumer = consumer
+		if handler.deadLetters != nil {
+			err = handler.deadLetters.open(t.client, handler.consumerOptions.DLQ.DeadLetterTopic)
 			if err != nil {
-				out.MessageObj = obj
+				t.mutex.Unlock()
+				_ = t.Stop()
+				return err
+			}
+		}
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	for _, handler := range t.handlers {
+		t.wg.Add(1)
+		go handler.consume(t.ctx, &t.wg, handler.consumer)
+		if handler.tracker != nil {
+			t.wg.Add(1)
+			go handler.trackAcks(t.ctx, &t.wg)
+		}
+	}
+	t.mutex.Unlock()
+	if failover, ok := t.connection.(pulsarconn.FailoverConnection); ok {
+		t.removeListener = failover.AddClientListener(t.switchClient)
+	}
+	return nil
+}
+
+// switchClient re-creates the consumers on the client of the cluster the connection failed over to
+func (t *Trigger) switchClient(client pulsar.Client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.client == nil {
+		return
+	}
+	t.client = client
+	for _, handler := range t.handlers {
+		previous := handler.consumer
+		if handler.deadLetters != nil {
+			err := handler.deadLetters.open(client, handler.consumerOptions.DLQ.DeadLetterTopic)
+			if err != nil {
+				logger.Errorf("could not re-create the dead letter producer of %s after failover: %v", handler.consumerOptions.SubscriptionName, err)
+			}
+		}
+		consumer, err := client.Subscribe(handler.consumerOptions)
+		if err != nil {
+			logger.Errorf("could not re-subscribe %s after failover, retrying every %v: %v", handler.consumerOptions.SubscriptionName, t.resubscribe, err)
+			handler.consumer = nil
+			if !handler.resubscribing {
+				handler.resubscribing = true
+				go t.retrySubscribe(t.ctx, handler)
 			}
 		} else {
-			out.Message = string(msg.Payload())
-		}
-		out.Key = msg.Key()
-		out.Properties = msg.Properties()
-		// Do something with the message
-		_, err = handler.handler.Handle(context.Background(), out)
-		if err == nil {
-			// Message processed successfully
-			handler.consumer.Ack(msg)
-		} else {
-			// Failed to process messages
-			handler.consumer.Nack(msg)
+			handler.consumer = consumer
+			t.wg.Add(1)
+			go handler.consume(t.ctx, &t.wg, consumer)
+		}
+		if previous != nil {
+			handler.closeConsumer(previous, false)
 		}
-		if !handler.running {
-			break
+	}
+}
+
+// retrySubscribe subscribes a handler the failover could not re-subscribe, it retries until it
+// succeeds, the trigger stops or a later failover subscribes the handler
+func (t *Trigger) retrySubscribe(ctx context.Context, handler *Handler) {
+	ticker := time.NewTicker(t.resubscribe)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if t.subscribeAgain(ctx, handler) {
+			return
+		}
+	}
+}
+
+// subscribeAgain makes one attempt of retrySubscribe, it reports false when it should be retried
+func (t *Trigger) subscribeAgain(ctx context.Context, handler *Handler) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if ctx.Err() != nil || handler.consumer != nil {
+		handler.resubscribing = false
+		return true
+	}
+	consumer, err := t.client.Subscribe(handler.consumerOptions)
+	if err != nil {
+		logger.Warnf("could not re-subscribe %s, retrying in %v: %v", handler.consumerOptions.SubscriptionName, t.resubscribe, err)
+		return false
+	}
+	logger.Infof("re-subscribed %s after failover", handler.consumerOptions.SubscriptionName)
+	handler.consumer = consumer
+	handler.resubscribing = false
+	t.wg.Add(1)
+	go handler.consume(t.ctx, &t.wg, consumer)
+	return true
+}
+
+// Stop implements util.Managed.Stop, it stops receiving, waits up to the drain timeout for the
+// messages being handled, then closes the consumers and releases the connection
+func (t *Trigger) Stop() error {
+	if t.removeListener != nil {
+		t.removeListener()
+		t.removeListener = nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+		if !waitTimeout(&t.wg, t.drainTimeout) {
+			logger.Warnf("closing consumers with messages still being handled after %v", t.drainTimeout)
+		}
+	}
+	for _, handler := range t.handlers {
+		if handler.deadLetters != nil {
+			handler.deadLetters.close()
+		}
+		if handler.consumer == nil {
+			continue
+		}
+		handler.closeConsumer(handler.consumer, handler.unsubscribeOnStop)
+		handler.consumer = nil
+	}
+	if t.client != nil {
+		t.connection.ReleaseConnection(t.client)
+		t.client = nil
+	}
+	return nil
+}
+
+// closeConsumer closes a consumer and drops its pending messages, the broker redelivers them
+func (h *Handler) closeConsumer(consumer pulsar.Consumer, unsubscribe bool) {
+	if h.pending != nil {
+		h.pending.RemovePendingMessages(consumer)
+	}
+	if h.tracker != nil {
+		h.tracker.removeConsumer(consumer)
+	}
+	if h.cumulative != nil {
+		h.cumulative.removeConsumer(consumer)
+	}
+	if unsubscribe {
+		err := consumer.Unsubscribe()
+		if err != nil {
+			logger.Warnf("could not unsubscribe %s: %v", h.consumerOptions.SubscriptionName, err)
 		}
 	}
+	consumer.Close()
 }
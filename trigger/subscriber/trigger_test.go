@@ -8,7 +8,7 @@ import (
 	"github.com/project-flogo/core/support/test"
 	"github.com/project-flogo/core/trigger"
 	"github.com/stretchr/testify/assert"
-	_ "github.com/wcn00/pulsar/connection"
+	_ "github.com/wcn00/pulsar/connector/connection"
 )
 
 const testConfig string = `{
@@ -16,7 +16,7 @@ const testConfig string = `{
 	"ref": " github.com/wcn00/pulsar/trigger",
 	"settings": {
 	  "connection": {
-		  "ref": "github.com/wcn00/pulsar/connection",
+		  "ref": "github.com/wcn00/pulsar/connector/connection",
 		  "settings":{
 			"url": "pulsar://gil:6605"
 		  }